@@ -0,0 +1,36 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "errors"
+
+// ErrClosed is returned by the context-aware lock methods of a mutex which was closed.
+var ErrClosed = errors.New("smutex: mutex is closed")
+
+// Close stops the mutex from accepting new locks and blocks until every lock which is
+// currently held was released, which gives a clear shutdown point. Once closed, Lock and
+// RLock panic, the Try variants return false and the Context variants return ErrClosed.
+// The holders can still unlock, upgrade or downgrade the shards they hold, but a holder
+// which tries to lock another shard panics, so Close must only be called once the users
+// of the mutex are winding down. Close can be called more than once.
+func (rw *SMutex128) Close() {
+	rw.closed.Store(true)
+	for i := range rw.mu {
+		rw.mu[i].lock()
+		rw.mu[i].unlock()
+	}
+}
+
+// IsClosed reports whether Close was called on the mutex.
+func (rw *SMutex128) IsClosed() bool {
+	return rw.closed.Load()
+}
+
+// panicClosed panics because the mutex is closed, with the name of the operation
+func (rw *SMutex128) panicClosed(op string) {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+	panic("smutex: " + op + " of closed mutex")
+}
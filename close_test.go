@@ -0,0 +1,60 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClose(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	mu.RLock(2)
+
+	closed := make(chan struct{})
+	go func() {
+		mu.Close()
+		close(closed)
+	}()
+
+	// Close waits for the holders, which can still release their shards
+	for !mu.IsClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned while the shards were held")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	mu.Unlock(1)
+	mu.RUnlock(2)
+	assertCompletes(t, time.Second, func() { <-closed })
+
+	// New acquisitions fail
+	assert.PanicsWithValue(t, "smutex: Lock of closed mutex", func() { mu.Lock(1) })
+	assert.PanicsWithValue(t, "smutex: RLock of closed mutex", func() { mu.RLock(1) })
+	assert.PanicsWithValue(t, "smutex: Lock of closed mutex", mu.LockAll)
+	assert.False(t, mu.TryLock(1))
+	assert.False(t, mu.TryRLock(1))
+	assert.Equal(t, ErrClosed, mu.LockContext(context.Background(), 1))
+	assert.Equal(t, ErrClosed, mu.RLockContext(context.Background(), 1))
+	assert.Equal(t, ErrClosed, mu.RLockAllContext(context.Background()))
+	assert.Zero(t, mu.WriterCount()+mu.ReaderCount())
+
+	// Closing again is fine
+	mu.Close()
+	assert.True(t, mu.IsClosed())
+}
+
+func TestCloseNamed(t *testing.T) {
+	mu := New(WithName("orders"))
+	mu.Close()
+	assert.PanicsWithValue(t, "smutex[orders]: Lock of closed mutex", func() { mu.Lock(1) })
+	assert.PanicsWithValue(t, "smutex[orders]: RLock of closed mutex", func() { mu.RLock(1) })
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "sync"
+
+// Wait atomically unlocks the shard, which must be locked for writing by the caller, and
+// suspends the calling goroutine until it is woken up by Signal or Broadcast on the same
+// shard. The shard is locked again before Wait returns. Just like sync.Cond, the caller
+// should check its condition in a loop, since it may have changed since the wake up.
+func (rw *SMutex128) Wait(shard uint) {
+	rw.condAt(rw.ShardOf(shard)).Wait()
+}
+
+// Signal wakes up one goroutine waiting on the shard, if there is any. The caller is
+// allowed, but not required, to hold the shard for writing.
+func (rw *SMutex128) Signal(shard uint) {
+	if cond := rw.mu[rw.ShardOf(shard)].cond.Load(); cond != nil {
+		cond.Signal()
+	}
+}
+
+// Broadcast wakes up all of the goroutines waiting on the shard. The caller is allowed,
+// but not required, to hold the shard for writing.
+func (rw *SMutex128) Broadcast(shard uint) {
+	if cond := rw.mu[rw.ShardOf(shard)].cond.Load(); cond != nil {
+		cond.Broadcast()
+	}
+}
+
+// condAt returns the condition variable of the shard at index i, creating it if needed
+func (rw *SMutex128) condAt(i uint) *sync.Cond {
+	if cond := rw.mu[i].cond.Load(); cond != nil {
+		return cond
+	}
+
+	rw.mu[i].cond.CompareAndSwap(nil, sync.NewCond(&indexLocker{rw: rw, at: i}))
+	return rw.mu[i].cond.Load()
+}
+
+// indexLocker represents a write lock on the shard at a given index
+type indexLocker struct {
+	rw *SMutex128
+	at uint
+}
+
+// Lock locks the shard for writing
+func (l *indexLocker) Lock() {
+	l.rw.lockAt(l.at)
+}
+
+// Unlock unlocks the shard for writing
+func (l *indexLocker) Unlock() {
+	l.rw.unlockAt(l.at)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCond(t *testing.T) {
+	const capacity, items = 4, 100
+	var mu SMutex128
+	var buffers [4][]int
+	var wg sync.WaitGroup
+
+	// Every shard guards a bounded buffer, filled by a producer and drained by a consumer
+	received := make([][]int, len(buffers))
+	for b := range buffers {
+		wg.Add(2)
+		go func(shard uint) {
+			defer wg.Done()
+			for i := 0; i < items; i++ {
+				mu.Lock(shard)
+				for len(buffers[shard]) == capacity {
+					mu.Wait(shard)
+				}
+				buffers[shard] = append(buffers[shard], i)
+				mu.Broadcast(shard)
+				mu.Unlock(shard)
+			}
+		}(uint(b))
+
+		go func(shard uint) {
+			defer wg.Done()
+			for i := 0; i < items; i++ {
+				mu.Lock(shard)
+				for len(buffers[shard]) == 0 {
+					mu.Wait(shard)
+				}
+				received[shard] = append(received[shard], buffers[shard][0])
+				buffers[shard] = buffers[shard][1:]
+				mu.Broadcast(shard)
+				mu.Unlock(shard)
+			}
+		}(uint(b))
+	}
+
+	assertCompletes(t, 10*time.Second, wg.Wait)
+	for b := range received {
+		assert.Len(t, received[b], items)
+		assert.Equal(t, 42, received[b][42])
+	}
+}
+
+func TestCondSignal(t *testing.T) {
+	mu := New(WithStats())
+	mu.Signal(1) // No-op without any waiter
+
+	var ready bool
+	done := make(chan struct{})
+	go func() {
+		mu.Lock(1)
+		for !ready {
+			mu.Wait(1)
+		}
+		mu.Unlock(1)
+		close(done)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	mu.Lock(1)
+	ready = true
+	mu.Signal(1)
+	mu.Unlock(1)
+
+	<-done
+	assert.Zero(t, mu.WriterCount())
+}
@@ -0,0 +1,189 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugCheck panics if any of the shards is still locked for reading or writing, naming
+// the first offending shard. It is meant to be called at the end of tests, once all of
+// the goroutines using the mutex are done, to catch locks which were never released.
+func (rw *SMutex128) DebugCheck() {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	for i := range rw.mu {
+		if rw.mu[i].writer.Load() != 0 {
+			panic("smutex: shard " + strconv.Itoa(i) + " is still locked for writing")
+		}
+		if n := rw.mu[i].readers.Load(); n != 0 {
+			panic("smutex: shard " + strconv.Itoa(i) + " is still locked by " + strconv.Itoa(int(n)) + " readers")
+		}
+	}
+}
+
+// DebugState returns the number of read locks and of write locks currently held across
+// all of the shards, gathered in a single pass. There is no global state word, so the
+// shards are read one after another and the result is a racy snapshot, only meant to
+// help diagnose a hang and never to make synchronization decisions.
+func (rw *SMutex128) DebugState() (readers, writers uint32) {
+	for i := range rw.mu {
+		if n := rw.mu[i].readers.Load(); n > 0 {
+			readers += uint32(n)
+		}
+		writers += rw.mu[i].writer.Load()
+	}
+	return
+}
+
+// owners tracks the goroutine holding each shard for writing
+type owners [shards]atomic.Int64
+
+// check panics if the current goroutine already holds the shard for writing
+func (o *owners) check(i uint) {
+	if o[i].Load() == goid() {
+		panic("smutex: recursive Lock of shard " + strconv.Itoa(int(i)))
+	}
+}
+
+// checkRUnlock panics with the index of the shard if it has no readers to unlock
+func (o *owners) checkRUnlock(s *shard, i uint) {
+	if s.readers.Load() <= 0 {
+		panic("smutex: RUnlock of unlocked shard " + strconv.Itoa(int(i)))
+	}
+}
+
+// acquire records the current goroutine as the writer of the shard
+func (o *owners) acquire(i uint) {
+	o[i].Store(goid())
+}
+
+// release clears the writer of the shard
+func (o *owners) release(i uint) {
+	o[i].Store(0)
+}
+
+// ------------------------------------------------------------------------------------
+
+// lockOrder tracks the shards held by every goroutine, for reading or writing
+type lockOrder struct {
+	mu   sync.Mutex
+	held map[int64]*[shards]int32
+}
+
+// check panics if the current goroutine holds a shard with a higher index than i
+func (o *lockOrder) check(i uint) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	held := o.held[goid()]
+	if held == nil {
+		return
+	}
+
+	for j := len(held) - 1; j > int(i); j-- {
+		if held[j] > 0 {
+			panic("smutex: locking shard " + strconv.Itoa(int(i)) + " while holding shard " + strconv.Itoa(j))
+		}
+	}
+}
+
+// acquire records that the current goroutine holds the shard
+func (o *lockOrder) acquire(i uint) {
+	id := goid()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.held == nil {
+		o.held = make(map[int64]*[shards]int32)
+	}
+	if o.held[id] == nil {
+		o.held[id] = new([shards]int32)
+	}
+
+	o.held[id][i]++
+}
+
+// release records that the current goroutine no longer holds the shard
+func (o *lockOrder) release(i uint) {
+	id := goid()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	held := o.held[id]
+	if held == nil || held[i] == 0 {
+		return
+	}
+
+	held[i]--
+	if *held == [shards]int32{} {
+		delete(o.held, id)
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// Leaks returns a description of every shard which has been locked for writing for longer
+// than the threshold set with WithHolderTracking(), along with the stack trace of the
+// goroutine which locked it. It returns nil if holder tracking is disabled.
+func (rw *SMutex128) Leaks() []string {
+	if rw.cfg == nil || rw.cfg.holders == nil {
+		return nil
+	}
+
+	var out []string
+	for i := range rw.cfg.holders.held {
+		h := rw.cfg.holders.held[i].Load()
+		if h == nil {
+			continue
+		}
+
+		if elapsed := time.Since(h.since); elapsed >= rw.cfg.holders.threshold {
+			out = append(out, "smutex: shard "+strconv.Itoa(i)+" locked for "+elapsed.String()+" by "+h.stack)
+		}
+	}
+	return out
+}
+
+// holders tracks the stack trace of the goroutine holding each shard for writing
+type holders struct {
+	threshold time.Duration
+	held      [shards]atomic.Pointer[holder]
+}
+
+// holder represents the goroutine which locked a shard for writing
+type holder struct {
+	since time.Time
+	stack string
+}
+
+// acquire records the current goroutine as the holder of the shard
+func (o *holders) acquire(i uint) {
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	o.held[i].Store(&holder{since: time.Now(), stack: string(buf)})
+}
+
+// release clears the holder of the shard
+func (o *holders) release(i uint) {
+	o.held[i].Store(nil)
+}
+
+// goid returns the identifier of the current goroutine, parsed from the header of its
+// stack trace. This is slow and only meant to be used by the options which need it.
+func goid() int64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
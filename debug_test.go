@@ -0,0 +1,167 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadlockDetection(t *testing.T) {
+	mu := New(WithDeadlockDetection())
+	mu.Lock(5)
+	assert.PanicsWithValue(t, "smutex: recursive Lock of shard 5", func() {
+		mu.Lock(5)
+	})
+
+	// Other shards and other goroutines are unaffected
+	mu.Lock(6)
+	mu.Unlock(6)
+	mu.Unlock(5)
+
+	done := make(chan struct{})
+	mu.Lock(5)
+	go func() {
+		mu.Lock(5)
+		mu.Unlock(5)
+		close(done)
+	}()
+	mu.Unlock(5)
+	<-done
+}
+
+func TestDeadlockDetectionRUnlock(t *testing.T) {
+	mu := New(WithDeadlockDetection(), WithName("orders"))
+	mu.RLock(5)
+	mu.RUnlock(5)
+	assert.PanicsWithValue(t, "smutex[orders]: RUnlock of unlocked shard 5", func() {
+		mu.RUnlock(5)
+	})
+
+	// The shard is left untouched and can still be used
+	assert.Zero(t, mu.ReaderCount())
+	mu.RLock(5)
+	mu.RUnlock(5)
+}
+
+func TestGoid(t *testing.T) {
+	id := goid()
+	assert.NotZero(t, id)
+	assert.Equal(t, id, goid())
+
+	other := make(chan int64)
+	go func() { other <- goid() }()
+	assert.NotEqual(t, id, <-other)
+}
+
+func TestDebugCheck(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	mu.Unlock(1)
+	mu.RLock(2)
+	mu.RUnlock(2)
+	assert.NotPanics(t, mu.DebugCheck)
+
+	mu.RLock(3)
+	mu.RLock(3)
+	assert.PanicsWithValue(t, "smutex: shard 3 is still locked by 2 readers", mu.DebugCheck)
+	mu.RUnlock(3)
+	mu.RUnlock(3)
+
+	mu.Lock(4)
+	assert.PanicsWithValue(t, "smutex: shard 4 is still locked for writing", mu.DebugCheck)
+	mu.Unlock(4)
+	assert.NotPanics(t, mu.DebugCheck)
+}
+
+func TestLockOrderCheck(t *testing.T) {
+	mu := New(WithLockOrderCheck())
+	mu.Lock(7)
+	assert.PanicsWithValue(t, "smutex: locking shard 3 while holding shard 7", func() {
+		mu.Lock(3)
+	})
+	assert.PanicsWithValue(t, "smutex: locking shard 3 while holding shard 7", func() {
+		mu.RLock(3)
+	})
+
+	// Ascending order is fine, and so are the shards locked without waiting
+	mu.Lock(9)
+	assert.True(t, mu.TryLock(3))
+	mu.Unlock(3)
+	mu.Unlock(9)
+	mu.Unlock(7)
+
+	mu.RLock(7)
+	assert.True(t, mu.Upgrade(7))
+	mu.Unlock(7)
+	assert.NotPanics(t, func() {
+		mu.LockMany(3, 7)
+		mu.UnlockMany(3, 7)
+		mu.Lock(3)
+		mu.Unlock(3)
+	})
+}
+
+func TestLockOrderCheckGoroutines(t *testing.T) {
+	mu := New(WithLockOrderCheck())
+	mu.Lock(7)
+	defer mu.Unlock(7)
+
+	// Other goroutines are tracked separately
+	done := make(chan struct{})
+	go func() {
+		mu.Lock(3)
+		mu.Unlock(3)
+		close(done)
+	}()
+	<-done
+}
+
+func TestDebugState(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	mu.Lock(2)
+	mu.RLock(3)
+	mu.RLock(3)
+	mu.RLock(4)
+
+	readers, writers := mu.DebugState()
+	assert.Equal(t, uint32(3), readers)
+	assert.Equal(t, uint32(2), writers)
+
+	mu.Unlock(1)
+	mu.Unlock(2)
+	mu.RUnlock(3)
+	mu.RUnlock(3)
+	mu.RUnlock(4)
+	readers, writers = mu.DebugState()
+	assert.Zero(t, readers)
+	assert.Zero(t, writers)
+}
+
+func TestLeaks(t *testing.T) {
+	mu := New(WithHolderTracking(10 * time.Millisecond))
+	mu.Lock(1)
+	mu.Lock(2)
+	assert.Empty(t, mu.Leaks())
+
+	time.Sleep(20 * time.Millisecond)
+	mu.Unlock(2)
+	leaks := mu.Leaks()
+	assert.Len(t, leaks, 1)
+	assert.Contains(t, leaks[0], "smutex: shard 1 locked for ")
+	assert.Contains(t, leaks[0], "TestLeaks")
+
+	mu.Unlock(1)
+	assert.Empty(t, mu.Leaks())
+}
+
+func TestLeaksDisabled(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	defer mu.Unlock(1)
+	assert.Nil(t, mu.Leaks())
+}
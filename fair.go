@@ -0,0 +1,63 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "sync"
+
+// turnstile hands a shard over to the writers in the order they arrived, using tickets
+type turnstile struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	next    uint64 // Ticket given to the next writer that arrives
+	serving uint64 // Ticket of the writer whose turn it is
+	held    bool   // Whether the current writer holds a ticket, only used by that writer
+}
+
+// lock waits for the turn of the caller and then locks the shard for writing
+func (t *turnstile) lock(s *shard) {
+	t.mu.Lock()
+	if t.cond.L == nil {
+		t.cond.L = &t.mu
+	}
+
+	ticket := t.next
+	t.next++
+	for t.serving != ticket {
+		t.cond.Wait()
+	}
+	t.mu.Unlock()
+
+	// Only readers or an upgrading reader can be in the way from here on
+	s.lock()
+	t.held = true
+}
+
+// tryLock locks the shard for writing only if no other writer is queued for it
+func (t *turnstile) tryLock(s *shard) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next != t.serving || !s.tryLock() {
+		return false
+	}
+
+	t.next++
+	t.held = true
+	return true
+}
+
+// release passes the turn on to the next writer in line, it must be called by the
+// writer before the shard is unlocked.
+func (t *turnstile) release() {
+	if !t.held {
+		return // Acquired through Upgrade, without a ticket
+	}
+
+	t.held = false
+	t.mu.Lock()
+	t.serving++
+	if t.cond.L != nil {
+		t.cond.Broadcast()
+	}
+	t.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairness(t *testing.T) {
+	const writers = 8
+	mu := New(WithFairness())
+	order := make([]int, 0, writers)
+
+	var wg sync.WaitGroup
+	mu.Lock(1)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			mu.Lock(1)
+			order = append(order, id)
+			mu.Unlock(1)
+		}(i)
+
+		// Wait for the writer to be queued before starting the next one
+		waitQueued(&mu.cfg.fair[1], uint64(i+2))
+	}
+
+	mu.Unlock(1)
+	assertCompletes(t, time.Second, wg.Wait)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, order)
+}
+
+func TestFairnessTryLock(t *testing.T) {
+	mu := New(WithFairness())
+	assert.True(t, mu.TryLock(1))
+	assert.False(t, mu.TryLock(1))
+
+	done := make(chan struct{})
+	go func() {
+		mu.Lock(1)
+		mu.Unlock(1)
+		close(done)
+	}()
+
+	// A queued writer keeps TryLock out even once the shard is free
+	waitQueued(&mu.cfg.fair[1], 2)
+	mu.Unlock(1)
+	<-done
+	assert.True(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestFairnessUpgrade(t *testing.T) {
+	mu := New(WithFairness())
+	mu.RLock(1)
+	assert.True(t, mu.Upgrade(1))
+	mu.Downgrade(1)
+	mu.RUnlock(1)
+
+	mu.RLock(1)
+	assert.True(t, mu.Upgrade(1))
+	mu.Unlock(1)
+
+	// The turnstile is left balanced
+	assertCompletes(t, time.Second, func() {
+		mu.Lock(1)
+		mu.Unlock(1)
+	})
+}
+
+// waitQueued waits until the turnstile has handed out the given number of tickets
+func waitQueued(t *turnstile, tickets uint64) {
+	for {
+		t.mu.Lock()
+		next := t.next
+		t.mu.Unlock()
+		if next >= tickets {
+			return
+		}
+		runtime.Gosched()
+	}
+}
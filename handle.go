@@ -0,0 +1,44 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+// WriteHandle represents a write lock held on a single shard, which can only be released
+// through its Unlock method.
+type WriteHandle struct {
+	rw *SMutex128
+	at uint // Index of the locked shard
+}
+
+// ReadHandle represents a read lock held on a single shard, which can only be released
+// through its Unlock method.
+type ReadHandle struct {
+	rw *SMutex128
+	at uint // Index of the locked shard
+}
+
+// LockHandle locks the shard for writing and returns a handle bound to the shard that
+// was actually locked, so that it can't be unlocked with a mismatched shard argument.
+func (rw *SMutex128) LockHandle(shard uint) WriteHandle {
+	i := rw.ShardOf(shard)
+	rw.lockAt(i)
+	return WriteHandle{rw: rw, at: i}
+}
+
+// RLockHandle locks the shard for reading and returns a handle bound to the shard that
+// was actually locked, so that it can't be unlocked with a mismatched shard argument.
+func (rw *SMutex128) RLockHandle(shard uint) ReadHandle {
+	i := rw.ShardOf(shard)
+	rw.rlockAt(i)
+	return ReadHandle{rw: rw, at: i}
+}
+
+// Unlock unlocks the shard for writing. It must be called exactly once.
+func (h WriteHandle) Unlock() {
+	h.rw.unlockAt(h.at)
+}
+
+// Unlock unlocks the shard for reading. It must be called exactly once.
+func (h ReadHandle) Unlock() {
+	h.rw.runlockAt(h.at)
+}
@@ -0,0 +1,38 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockHandle(t *testing.T) {
+	key := uint(1)
+	mu := New(WithHash(func(k uint) uint { return k + key }))
+	h := mu.LockHandle(5)
+	assert.False(t, mu.TryRLock(5))
+
+	// The handle unlocks the shard it locked, even though key 5 now maps elsewhere
+	key = 2
+	h.Unlock()
+	key = 1
+	assert.False(t, mu.IsLocked(5))
+	assert.True(t, mu.TryLock(5))
+	mu.Unlock(5)
+}
+
+func TestRLockHandle(t *testing.T) {
+	key := uint(1)
+	mu := New(WithHash(func(k uint) uint { return k + key }))
+	h := mu.RLockHandle(5)
+	assert.False(t, mu.TryLock(5))
+
+	key = 2
+	h.Unlock()
+	key = 1
+	assert.True(t, mu.TryLock(5))
+	mu.Unlock(5)
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+// LockIndex locks for writing the shard at index i, which must be in the range [0,
+// Shards()). Unlike Lock, the index is used as is, without the custom hash or the modulo,
+// for callers which already bucket their data by shard. It panics if i is out of range.
+func (rw *SMutex128) LockIndex(i uint) {
+	rw.lockAt(i)
+}
+
+// UnlockIndex unlocks for writing the shard at index i, locked with LockIndex.
+func (rw *SMutex128) UnlockIndex(i uint) {
+	rw.unlockAt(i)
+}
+
+// RLockIndex locks for reading the shard at index i, which must be in the range [0,
+// Shards()). It panics if i is out of range.
+func (rw *SMutex128) RLockIndex(i uint) {
+	rw.rlockAt(i)
+}
+
+// RUnlockIndex unlocks for reading the shard at index i, locked with RLockIndex.
+func (rw *SMutex128) RUnlockIndex(i uint) {
+	rw.runlockAt(i)
+}
+
+// RLockResolve locks for reading the shard the key corresponds to and returns its index,
+// so that the caller can use the very same index to access its own sharded data and to
+// unlock the shard afterwards with RUnlockIndex, without mapping the key a second time.
+func (rw *SMutex128) RLockResolve(key uint) (shard uint) {
+	shard = rw.ShardOf(key)
+	rw.rlockAt(shard)
+	return shard
+}
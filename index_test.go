@@ -0,0 +1,71 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkLockIndex(b *testing.B) {
+	b.Run("lock", func(b *testing.B) {
+		var mu SMutex128
+		for i := 0; i < b.N; i++ {
+			mu.Lock(1)
+			mu.Unlock(1)
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		var mu SMutex128
+		for i := 0; i < b.N; i++ {
+			mu.LockIndex(1)
+			mu.UnlockIndex(1)
+		}
+	})
+}
+
+func TestLockIndex(t *testing.T) {
+	var mu SMutex128
+	for i := uint(0); i < shards; i++ {
+		mu.LockIndex(i)
+		assert.True(t, mu.IsLocked(i))
+		mu.UnlockIndex(i)
+
+		mu.RLockIndex(i)
+		assert.False(t, mu.TryLock(i))
+		mu.RUnlockIndex(i)
+		assert.True(t, mu.TryLock(i))
+		mu.Unlock(i)
+	}
+}
+
+func TestLockIndexOutOfRange(t *testing.T) {
+	var mu SMutex128
+	assert.Panics(t, func() {
+		mu.LockIndex(shards)
+	})
+}
+
+func TestLockIndexSkipsHash(t *testing.T) {
+	mu := New(WithHash(func(k uint) uint { return k + 1 }))
+	mu.LockIndex(3)
+	assert.True(t, mu.IsLocked(2))
+	assert.False(t, mu.IsLocked(3))
+	mu.UnlockIndex(3)
+}
+
+func TestRLockResolve(t *testing.T) {
+	mu := New(WithHash(func(k uint) uint { return k + 1 }))
+	for _, key := range []uint{0, 3, shards - 1, shards + 5} {
+		shard := mu.RLockResolve(key)
+		assert.Equal(t, mu.ShardOf(key), shard)
+		assert.Equal(t, 1, mu.ReaderCount())
+		assert.False(t, mu.TryLock(key))
+
+		mu.RUnlockIndex(shard)
+		assert.Zero(t, mu.ReaderCount())
+	}
+}
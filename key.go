@@ -0,0 +1,70 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// LockKey locks rw for writing the shard which the string key hashes to.
+func (rw *SMutex128) LockKey(key string) {
+	rw.Lock(hashString(key))
+}
+
+// UnlockKey unlocks rw for writing the shard which the string key hashes to.
+func (rw *SMutex128) UnlockKey(key string) {
+	rw.Unlock(hashString(key))
+}
+
+// RLockKey locks rw for reading the shard which the string key hashes to.
+func (rw *SMutex128) RLockKey(key string) {
+	rw.RLock(hashString(key))
+}
+
+// RUnlockKey unlocks rw for reading the shard which the string key hashes to.
+func (rw *SMutex128) RUnlockKey(key string) {
+	rw.RUnlock(hashString(key))
+}
+
+// LockBytes locks rw for writing the shard which the byte slice key hashes to.
+func (rw *SMutex128) LockBytes(key []byte) {
+	rw.Lock(hashBytes(key))
+}
+
+// UnlockBytes unlocks rw for writing the shard which the byte slice key hashes to.
+func (rw *SMutex128) UnlockBytes(key []byte) {
+	rw.Unlock(hashBytes(key))
+}
+
+// RLockBytes locks rw for reading the shard which the byte slice key hashes to.
+func (rw *SMutex128) RLockBytes(key []byte) {
+	rw.RLock(hashBytes(key))
+}
+
+// RUnlockBytes unlocks rw for reading the shard which the byte slice key hashes to.
+func (rw *SMutex128) RUnlockBytes(key []byte) {
+	rw.RUnlock(hashBytes(key))
+}
+
+// hashString computes a 64-bit FNV-1a hash of the key, without allocating.
+func hashString(key string) uint {
+	hash := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+	return uint(hash)
+}
+
+// hashBytes computes a 64-bit FNV-1a hash of the key, the same as hashString does for
+// a string with the same content.
+func hashBytes(key []byte) uint {
+	hash := uint64(offset64)
+	for _, b := range key {
+		hash ^= uint64(b)
+		hash *= prime64
+	}
+	return uint(hash)
+}
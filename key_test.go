@@ -0,0 +1,83 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockKey(t *testing.T) {
+	var mu SMutex128
+	shard := mu.ShardOf(hashString("alice"))
+	assert.Equal(t, hashString("alice"), hashString("alice"))
+
+	mu.LockKey("alice")
+	assert.False(t, mu.TryRLock(shard))
+	mu.UnlockKey("alice")
+	assert.True(t, mu.TryLock(shard))
+	mu.Unlock(shard)
+
+	mu.RLockKey("alice")
+	assert.False(t, mu.TryLock(shard))
+	mu.RUnlockKey("alice")
+	assert.True(t, mu.TryLock(shard))
+	mu.Unlock(shard)
+}
+
+func TestLockKeyIndependent(t *testing.T) {
+	var mu SMutex128
+	a, b := "alice", "bob"
+	assert.NotEqual(t, mu.ShardOf(hashString(a)), mu.ShardOf(hashString(b)))
+
+	// Both keys can be held at the same time
+	mu.LockKey(a)
+	mu.LockKey(b)
+	mu.UnlockKey(b)
+	mu.UnlockKey(a)
+}
+
+func TestLockBytes(t *testing.T) {
+	var mu SMutex128
+	key := []byte("alice")
+	shard := mu.ShardOf(hashBytes(key))
+	assert.Equal(t, shard, mu.ShardOf(hashBytes([]byte("alice"))))
+
+	mu.LockBytes(key)
+	assert.False(t, mu.TryRLock(shard))
+	mu.UnlockBytes([]byte("alice"))
+	assert.True(t, mu.TryLock(shard))
+	mu.Unlock(shard)
+
+	mu.RLockBytes(key)
+	assert.False(t, mu.TryLock(shard))
+	mu.RUnlockBytes(key)
+	assert.True(t, mu.TryLock(shard))
+	mu.Unlock(shard)
+}
+
+func TestLockBytesAllocs(t *testing.T) {
+	var mu SMutex128
+	key := []byte("alice")
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		mu.LockBytes(key)
+		mu.UnlockBytes(key)
+	}))
+}
+
+func TestHashBytes(t *testing.T) {
+	for _, key := range []string{"", "a", "alice", "/var/lib/data"} {
+		assert.Equal(t, hashString(key), hashBytes([]byte(key)))
+	}
+}
+
+func TestHashString(t *testing.T) {
+	for _, key := range []string{"", "a", "alice", "/var/lib/data"} {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		assert.Equal(t, uint(h.Sum64()), hashString(key))
+	}
+}
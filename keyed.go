@@ -0,0 +1,147 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// SMutex represents a sharded RWMutex which accepts arbitrary comparable keys. The keys
+// are hashed with a random seed, so their distribution across the shards cannot be
+// controlled by an adversary. A zero value SMutex picks its seed on first use.
+//
+// Keys containing a floating-point NaN never compare equal to themselves and hash to a
+// different shard each time, so locking them panics.
+type SMutex[K comparable] struct {
+	mu   SMutex128
+	once sync.Once
+	seed maphash.Seed
+}
+
+// NewOf creates a new sharded mutex for keys of type K, using a random hash seed.
+func NewOf[K comparable]() *SMutex[K] {
+	rw := new(SMutex[K])
+	rw.once.Do(rw.init)
+	return rw
+}
+
+// Lock locks rw for writing the shard which the key hashes to.
+func (rw *SMutex[K]) Lock(key K) {
+	rw.mu.Lock(rw.hash(key))
+}
+
+// Unlock unlocks rw for writing the shard which the key hashes to.
+func (rw *SMutex[K]) Unlock(key K) {
+	rw.mu.Unlock(rw.hash(key))
+}
+
+// RLock locks rw for reading the shard which the key hashes to.
+func (rw *SMutex[K]) RLock(key K) {
+	rw.mu.RLock(rw.hash(key))
+}
+
+// RUnlock unlocks rw for reading the shard which the key hashes to.
+func (rw *SMutex[K]) RUnlock(key K) {
+	rw.mu.RUnlock(rw.hash(key))
+}
+
+// init picks a random hash seed
+func (rw *SMutex[K]) init() {
+	rw.seed = maphash.MakeSeed()
+}
+
+// hash computes the seeded hash of the key
+func (rw *SMutex[K]) hash(key K) uint {
+	if key != key {
+		panic("smutex: key contains NaN")
+	}
+
+	rw.once.Do(rw.init)
+	var h maphash.Hash
+	h.SetSeed(rw.seed)
+	writeKey(&h, key)
+	return uint(h.Sum64())
+}
+
+// writeKey writes the key into the hash, such that equal keys always write the same bytes
+func writeKey(h *maphash.Hash, key any) {
+	switch k := key.(type) {
+	case string:
+		h.WriteString(k)
+	case int:
+		writeUint(h, uint64(k))
+	case int32:
+		writeUint(h, uint64(k))
+	case int64:
+		writeUint(h, uint64(k))
+	case uint:
+		writeUint(h, uint64(k))
+	case uint32:
+		writeUint(h, uint64(k))
+	case uint64:
+		writeUint(h, k)
+	default:
+		writeValue(h, reflect.ValueOf(key))
+	}
+}
+
+// writeValue writes any comparable value into the hash, walking through its fields and
+// elements. Just like the == operator, pointers and channels are compared by address,
+// blank struct fields are ignored and negative zero is equal to zero.
+func writeValue(h *maphash.Hash, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			h.WriteByte(1)
+		} else {
+			h.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(h, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(h, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeFloat(h, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		writeFloat(h, real(v.Complex()))
+		writeFloat(h, imag(v.Complex()))
+	case reflect.String:
+		h.WriteString(v.String())
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		writeUint(h, uint64(v.Pointer()))
+	case reflect.Interface:
+		if !v.IsNil() {
+			writeValue(h, v.Elem())
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			writeValue(h, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).Name != "_" {
+				writeValue(h, v.Field(i))
+			}
+		}
+	}
+}
+
+// writeUint writes the integer into the hash
+func writeUint(h *maphash.Hash, n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	h.Write(b[:])
+}
+
+// writeFloat writes the float into the hash, with negative zero written as zero
+func writeFloat(h *maphash.Hash, f float64) {
+	if f == 0 {
+		f = 0
+	}
+	writeUint(h, math.Float64bits(f))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"hash/maphash"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type userKey struct {
+	Tenant string
+	ID     int
+}
+
+func TestKeyed(t *testing.T) {
+	mu := NewOf[userKey]()
+	key := userKey{Tenant: "acme", ID: 42}
+	shard := mu.mu.ShardOf(mu.hash(key))
+
+	mu.Lock(key)
+	assert.False(t, mu.mu.TryRLock(shard))
+	mu.Unlock(key)
+	assert.True(t, mu.mu.TryLock(shard))
+	mu.mu.Unlock(shard)
+
+	mu.RLock(key)
+	assert.False(t, mu.mu.TryLock(shard))
+	mu.RUnlock(key)
+	assert.True(t, mu.mu.TryLock(shard))
+	mu.mu.Unlock(shard)
+}
+
+func TestKeyedIndependent(t *testing.T) {
+	mu := NewOf[userKey]()
+	a := userKey{Tenant: "acme", ID: 1}
+	b := userKey{Tenant: "acme", ID: 2}
+	for mu.mu.ShardOf(mu.hash(a)) == mu.mu.ShardOf(mu.hash(b)) {
+		b.ID++
+	}
+
+	// Keys landing on different shards can be held at the same time
+	mu.Lock(a)
+	mu.Lock(b)
+	mu.Unlock(b)
+	mu.Unlock(a)
+}
+
+func TestKeyedZeroValue(t *testing.T) {
+	var a, b SMutex[string]
+	assert.NotEqual(t, a.hash("key"), b.hash("key"))
+	assert.Equal(t, a.hash("key"), a.hash("key"))
+
+	a.Lock("key")
+	a.Unlock("key")
+}
+
+func TestKeyedNaN(t *testing.T) {
+	mu := NewOf[float64]()
+	assert.PanicsWithValue(t, "smutex: key contains NaN", func() {
+		mu.Lock(math.NaN())
+	})
+
+	type point struct{ X, Y float64 }
+	assert.PanicsWithValue(t, "smutex: key contains NaN", func() {
+		NewOf[point]().RLock(point{X: 1, Y: math.NaN()})
+	})
+}
+
+func TestKeyedHashEqualKeys(t *testing.T) {
+	type inner struct {
+		_    int
+		Name string
+		Tags [2]string
+	}
+	type key struct {
+		Ptr   *int
+		Value float64
+		Inner inner
+	}
+
+	// Equal keys always hash the same, no matter how they were built
+	n := 1
+	mu := NewOf[key]()
+	a := key{Ptr: &n, Value: 0, Inner: inner{Name: "a", Tags: [2]string{"x", "y"}}}
+	b := key{Ptr: &n, Value: math.Copysign(0, -1), Inner: inner{Name: "a", Tags: [2]string{"x", "y"}}}
+	assert.True(t, a == b)
+	assert.Equal(t, mu.hash(a), mu.hash(b))
+
+	// Pointers are hashed by address rather than by the value they point to
+	n = 2
+	assert.Equal(t, mu.hash(a), mu.hash(b))
+	m := 2
+	b.Ptr = &m
+	assert.NotEqual(t, mu.hash(a), mu.hash(b))
+}
+
+func TestKeyedHashKinds(t *testing.T) {
+	seed := maphash.MakeSeed()
+	for _, key := range []any{
+		"key", 1, int8(1), int32(1), int64(1), uint(1), uint16(1), uint32(1), uint64(1),
+		true, float32(1.5), complex(1, 2), [2]int{1, 2}, make(chan int), [1]any{"a"},
+	} {
+		assert.Equal(t, sumKey(seed, key), sumKey(seed, key), "%T", key)
+	}
+}
+
+// sumKey hashes a key of any type with the seed
+func sumKey(seed maphash.Seed, key any) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+	writeKey(&h, key)
+	return h.Sum64()
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// LockLocal locks for writing a shard picked by affinity with the processor running the
+// caller, so that goroutines scheduled on the same processor tend to reuse the same shard
+// and keep it hot in the cache. This suits data where any shard will do, such as sharded
+// counters, since the same caller is not guaranteed to get the same shard twice. The
+// returned handle tells which shard was locked, and must be used to unlock it.
+func (rw *SMutex128) LockLocal() WriteHandle {
+	slot := local.Get().(*uint)
+	h := rw.LockHandle(*slot)
+	local.Put(slot)
+	return h
+}
+
+// Shard returns the index of the locked shard, in the range [0, Shards()).
+func (h WriteHandle) Shard() uint {
+	return h.at
+}
+
+// Shard returns the index of the locked shard, in the range [0, Shards()).
+func (h ReadHandle) Shard() uint {
+	return h.at
+}
+
+// local hands out shard slots, relying on sync.Pool keeping a cache per processor
+var local = sync.Pool{
+	New: func() any {
+		slot := uint(nextSlot.Add(1))
+		return &slot
+	},
+}
+
+// nextSlot is the last shard slot handed out by the pool
+var nextSlot atomic.Uint32
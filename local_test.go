@@ -0,0 +1,73 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkLockLocal(b *testing.B) {
+	b.Run("shared", func(b *testing.B) {
+		var mu SMutex128
+		var counters [shards]paddedCounter
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				shard := uint(next.Add(1)) % shards
+				mu.Lock(shard)
+				counters[shard].value++
+				mu.Unlock(shard)
+			}
+		})
+	})
+
+	b.Run("local", func(b *testing.B) {
+		var mu SMutex128
+		var counters [shards]paddedCounter
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				h := mu.LockLocal()
+				counters[h.Shard()].value++
+				h.Unlock()
+			}
+		})
+	})
+}
+
+func TestLockLocal(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var counters [shards]int
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				h := mu.LockLocal()
+				assert.True(t, mu.IsLocked(h.Shard()))
+				counters[h.Shard()]++
+				h.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	total := 0
+	for _, n := range counters {
+		total += n
+	}
+	assert.Equal(t, 8000, total)
+	assert.Zero(t, mu.WriterCount())
+}
+
+// paddedCounter is a counter which sits on its own cache line
+type paddedCounter struct {
+	value int
+	_     [56]byte
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "sync"
+
+// Locker represents the core method set of a sharded mutex, which lets code depend on an
+// interface rather than on *SMutex128, for example to inject a fake in unit tests.
+type Locker interface {
+	Shards() uint
+	Lock(shard uint)
+	Unlock(shard uint)
+	RLock(shard uint)
+	RUnlock(shard uint)
+	RLockAll()
+	RUnlockAll()
+}
+
+var _ Locker = (*SMutex128)(nil)
+
+// Locker returns a sync.Locker interface which locks and unlocks the shard for writing.
+func (rw *SMutex128) Locker(shard uint) sync.Locker {
+	return &writeLocker{rw: rw, shard: shard}
+}
+
+// RLocker returns a sync.Locker interface which locks and unlocks the shard for reading,
+// similarly to sync.RWMutex.RLocker().
+func (rw *SMutex128) RLocker(shard uint) sync.Locker {
+	return &readLocker{rw: rw, shard: shard}
+}
+
+// AsRWMutex returns an adapter bound to the shard, with the method set of sync.RWMutex, so
+// that the shard can be passed to code written against a *sync.RWMutex through an
+// interface. This eases migrating one data structure at a time.
+func (rw *SMutex128) AsRWMutex(shard uint) *RWMutex {
+	return &RWMutex{rw: rw, shard: shard}
+}
+
+// RWMutex represents a single shard of a sharded mutex, with the method set of
+// sync.RWMutex. It is created with AsRWMutex.
+type RWMutex struct {
+	rw    *SMutex128
+	shard uint
+}
+
+// Lock locks the shard for writing
+func (m *RWMutex) Lock() {
+	m.rw.Lock(m.shard)
+}
+
+// TryLock tries to lock the shard for writing and reports whether it succeeded
+func (m *RWMutex) TryLock() bool {
+	return m.rw.TryLock(m.shard)
+}
+
+// Unlock unlocks the shard for writing
+func (m *RWMutex) Unlock() {
+	m.rw.Unlock(m.shard)
+}
+
+// RLock locks the shard for reading
+func (m *RWMutex) RLock() {
+	m.rw.RLock(m.shard)
+}
+
+// TryRLock tries to lock the shard for reading and reports whether it succeeded
+func (m *RWMutex) TryRLock() bool {
+	return m.rw.TryRLock(m.shard)
+}
+
+// RUnlock unlocks the shard for reading
+func (m *RWMutex) RUnlock() {
+	m.rw.RUnlock(m.shard)
+}
+
+// RLocker returns a sync.Locker interface which locks and unlocks the shard for reading
+func (m *RWMutex) RLocker() sync.Locker {
+	return m.rw.RLocker(m.shard)
+}
+
+// writeLocker represents a write lock on a single shard
+type writeLocker struct {
+	rw    *SMutex128
+	shard uint
+}
+
+// Lock locks the shard for writing
+func (l *writeLocker) Lock() {
+	l.rw.Lock(l.shard)
+}
+
+// Unlock unlocks the shard for writing
+func (l *writeLocker) Unlock() {
+	l.rw.Unlock(l.shard)
+}
+
+// readLocker represents a read lock on a single shard
+type readLocker struct {
+	rw    *SMutex128
+	shard uint
+}
+
+// Lock locks the shard for reading
+func (l *readLocker) Lock() {
+	l.rw.RLock(l.shard)
+}
+
+// Unlock unlocks the shard for reading
+func (l *readLocker) Unlock() {
+	l.rw.RUnlock(l.shard)
+}
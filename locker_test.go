@@ -0,0 +1,107 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocker(t *testing.T) {
+	var mu SMutex128
+	var ready bool
+	cond := sync.NewCond(mu.Locker(3))
+
+	go func() {
+		cond.L.Lock()
+		ready = true
+		cond.L.Unlock()
+		cond.Signal()
+	}()
+
+	cond.L.Lock()
+	for !ready {
+		cond.Wait()
+	}
+	assert.False(t, mu.TryRLock(3))
+	cond.L.Unlock()
+	assert.True(t, mu.TryLock(3))
+	mu.Unlock(3)
+}
+
+func TestRLocker(t *testing.T) {
+	var mu SMutex128
+	var l sync.Locker = mu.RLocker(3)
+
+	l.Lock()
+	assert.False(t, mu.TryLock(3))
+	assert.True(t, mu.TryRLock(3))
+	mu.RUnlock(3)
+	l.Unlock()
+
+	assert.True(t, mu.TryLock(3))
+	mu.Unlock(3)
+}
+
+func TestAsRWMutex(t *testing.T) {
+	type rwMutex interface {
+		Lock()
+		Unlock()
+		RLock()
+		RUnlock()
+		RLocker() sync.Locker
+	}
+
+	var mu SMutex128
+	var std sync.RWMutex
+	for _, m := range []rwMutex{&std, mu.AsRWMutex(3)} {
+		m.Lock()
+		m.Unlock()
+		m.RLock()
+		m.RLocker().Lock()
+		m.RLocker().Unlock()
+		m.RUnlock()
+	}
+
+	m := mu.AsRWMutex(3)
+	m.RLock()
+	assert.False(t, mu.TryLock(3))
+	assert.False(t, m.TryLock())
+	assert.True(t, m.TryRLock())
+	m.RUnlock()
+	m.RUnlock()
+	assert.True(t, m.TryLock())
+	assert.True(t, mu.IsLocked(3))
+	m.Unlock()
+}
+
+func TestLockerInterface(t *testing.T) {
+	var fake fakeLocker
+	var l Locker = &fake
+	l.Lock(1)
+	l.Unlock(1)
+	l.RLockAll()
+	l.RUnlockAll()
+	assert.Equal(t, []string{"Lock(1)", "Unlock(1)", "RLockAll", "RUnlockAll"}, fake.calls)
+	assert.Equal(t, uint(1), l.Shards())
+}
+
+// fakeLocker records the calls made to it, without locking anything
+type fakeLocker struct {
+	calls []string
+}
+
+func (f *fakeLocker) Shards() uint       { return 1 }
+func (f *fakeLocker) Lock(shard uint)    { f.record("Lock", shard) }
+func (f *fakeLocker) Unlock(shard uint)  { f.record("Unlock", shard) }
+func (f *fakeLocker) RLock(shard uint)   { f.record("RLock", shard) }
+func (f *fakeLocker) RUnlock(shard uint) { f.record("RUnlock", shard) }
+func (f *fakeLocker) RLockAll()          { f.calls = append(f.calls, "RLockAll") }
+func (f *fakeLocker) RUnlockAll()        { f.calls = append(f.calls, "RUnlockAll") }
+func (f *fakeLocker) record(op string, shard uint) {
+	f.calls = append(f.calls, fmt.Sprintf("%s(%d)", op, shard))
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"math/bits"
+	"strconv"
+	"unsafe"
+)
+
+// LockMany locks for writing every shard the given keys correspond to. The shards are
+// deduplicated and always acquired in ascending order, so concurrent LockMany calls
+// with overlapping keys never deadlock against each other, nor against LockAll.
+func (rw *SMutex128) LockMany(keys ...uint) {
+	set := rw.resolve(keys)
+	set.each(func(i uint) {
+		rw.lockAt(i)
+	})
+}
+
+// UnlockMany unlocks for writing every shard the given keys correspond to. The keys
+// must resolve to the same shards as the keys passed to the matching LockMany call.
+func (rw *SMutex128) UnlockMany(keys ...uint) {
+	set := rw.resolve(keys)
+	set.each(func(i uint) {
+		rw.unlockAt(i)
+	})
+}
+
+// RLockMany locks for reading every shard the given keys correspond to. The shards are
+// deduplicated and acquired in ascending order, just like LockMany.
+func (rw *SMutex128) RLockMany(keys ...uint) {
+	set := rw.resolve(keys)
+	set.each(func(i uint) {
+		rw.rlockAt(i)
+	})
+}
+
+// RUnlockMany unlocks for reading every shard the given keys correspond to. The keys
+// must resolve to the same shards as the keys passed to the matching RLockMany call.
+func (rw *SMutex128) RUnlockMany(keys ...uint) {
+	set := rw.resolve(keys)
+	set.each(func(i uint) {
+		rw.runlockAt(i)
+	})
+}
+
+// LockBoth locks for writing the shard of key ka in a and the shard of key kb in b. The
+// two mutexes are always acquired in the order of their addresses, so concurrent LockBoth
+// calls on the same pair of mutexes never deadlock, whichever order the pair is given in.
+// If a and b are the same mutex, it behaves like a.LockMany(ka, kb).
+func LockBoth(a, b *SMutex128, ka, kb uint) {
+	switch {
+	case a == b:
+		a.LockMany(ka, kb)
+	case before(a, b):
+		a.Lock(ka)
+		b.Lock(kb)
+	default:
+		b.Lock(kb)
+		a.Lock(ka)
+	}
+}
+
+// UnlockBoth unlocks for writing the shards locked by the matching LockBoth call, in the
+// reverse order they were acquired.
+func UnlockBoth(a, b *SMutex128, ka, kb uint) {
+	switch {
+	case a == b:
+		a.UnlockMany(ka, kb)
+	case before(a, b):
+		b.Unlock(kb)
+		a.Unlock(ka)
+	default:
+		a.Unlock(ka)
+		b.Unlock(kb)
+	}
+}
+
+// before reports whether the mutex a must be locked before the mutex b. The garbage
+// collector never moves heap objects, so the addresses give a stable global order.
+func before(a, b *SMutex128) bool {
+	return uintptr(unsafe.Pointer(a)) < uintptr(unsafe.Pointer(b))
+}
+
+// LockRange locks for writing the shards with an index in the half-open range [start, end),
+// in ascending order. Just like LockIndex, the indices are used as is, without the custom
+// hash or the modulo. It panics if the range does not fit within [0, Shards()).
+func (rw *SMutex128) LockRange(start, end uint) {
+	checkRange(start, end)
+	for i := start; i < end; i++ {
+		rw.lockAt(i)
+	}
+}
+
+// UnlockRange unlocks for writing the shards with an index in the half-open range
+// [start, end), which must have been locked with LockRange.
+func (rw *SMutex128) UnlockRange(start, end uint) {
+	checkRange(start, end)
+	for i := start; i < end; i++ {
+		rw.unlockAt(i)
+	}
+}
+
+// checkRange panics if the range of shard indices is invalid
+func checkRange(start, end uint) {
+	if start > end || end > shards {
+		panic("smutex: invalid shard range [" + strconv.Itoa(int(start)) + ", " + strconv.Itoa(int(end)) + ")")
+	}
+}
+
+// LockSet returns an empty set of keys, which can be built up incrementally and then
+// acquired all at once, just like LockMany.
+func (rw *SMutex128) LockSet() *LockSet {
+	return &LockSet{rw: rw}
+}
+
+// LockSet represents a set of shards which are locked together for writing. Keys are
+// mapped to their shards as they are added, so the set itself never allocates.
+type LockSet struct {
+	rw   *SMutex128
+	set  shardSet
+	held bool
+}
+
+// Add adds the shard which the key corresponds to into the set. It may only be called
+// while the set is not acquired.
+func (s *LockSet) Add(key uint) {
+	if s.held {
+		panic("smutex: Add to an acquired LockSet")
+	}
+
+	s.set.add(s.rw.ShardOf(key))
+}
+
+// Acquire locks for writing every shard of the set, in ascending order.
+func (s *LockSet) Acquire() {
+	if s.held {
+		panic("smutex: Acquire of an acquired LockSet")
+	}
+
+	s.set.each(s.rw.lockAt)
+	s.held = true
+}
+
+// Release unlocks every shard of the set, which can then be modified or acquired again.
+func (s *LockSet) Release() {
+	if !s.held {
+		panic("smutex: Release of an unacquired LockSet")
+	}
+
+	s.held = false
+	s.set.each(s.rw.unlockAt)
+}
+
+// resolve maps the keys into a deduplicated set of shards
+func (rw *SMutex128) resolve(keys []uint) (set shardSet) {
+	for _, key := range keys {
+		set.add(rw.ShardOf(key))
+	}
+	return
+}
+
+// ------------------------------------------------------------------------------------
+
+// shardSet represents a set of shard indices
+type shardSet [shards / 64]uint64
+
+// add adds the shard index to the set
+func (s *shardSet) add(i uint) {
+	s[i/64] |= 1 << (i % 64)
+}
+
+// each calls fn for every shard in the set, in ascending order
+func (s *shardSet) each(fn func(i uint)) {
+	for b, block := range s {
+		for block != 0 {
+			bit := uint(bits.TrailingZeros64(block))
+			fn(uint(b)*64 + bit)
+			block &= block - 1
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockMany(t *testing.T) {
+	var mu SMutex128
+	mu.LockMany(5, 1, aliasOf(&mu, 5), 5)
+	assert.False(t, mu.TryRLock(1))
+	assert.False(t, mu.TryRLock(5))
+	assert.True(t, mu.TryLock(2))
+	mu.Unlock(2)
+
+	mu.UnlockMany(5, 1)
+	for i := uint(0); i < shards; i++ {
+		assert.True(t, mu.TryLock(i))
+		mu.Unlock(i)
+	}
+}
+
+func TestLockManyStress(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for n := 0; n < 200; n++ {
+				keys := []uint{uint(rnd.Intn(8)), uint(rnd.Intn(8)), uint(rnd.Intn(8))}
+				mu.LockMany(keys...)
+				mu.UnlockMany(keys...)
+			}
+		}(int64(i))
+	}
+
+	assertCompletes(t, 10*time.Second, wg.Wait)
+}
+
+func TestLockBoth(t *testing.T) {
+	var a, b SMutex128
+	LockBoth(&a, &b, 1, 2)
+	assert.True(t, a.IsLocked(1))
+	assert.True(t, b.IsLocked(2))
+	UnlockBoth(&a, &b, 1, 2)
+	assert.Zero(t, a.WriterCount()+b.WriterCount())
+
+	// The same mutex twice, with keys on the same shard
+	LockBoth(&a, &a, 3, 3)
+	assert.Equal(t, 1, a.WriterCount())
+	UnlockBoth(&a, &a, 3, 3)
+	assert.Zero(t, a.WriterCount())
+}
+
+func TestLockBothStress(t *testing.T) {
+	var a, b SMutex128
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(reversed bool) {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				if reversed {
+					LockBoth(&b, &a, 1, 1)
+					runtime.Gosched()
+					UnlockBoth(&b, &a, 1, 1)
+				} else {
+					LockBoth(&a, &b, 1, 1)
+					runtime.Gosched()
+					UnlockBoth(&a, &b, 1, 1)
+				}
+			}
+		}(i == 1)
+	}
+
+	assertCompletes(t, 10*time.Second, wg.Wait)
+}
+
+func TestLockManyWithLockAll(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+
+	// Every multi-shard operation locks in ascending order, so they compose with each
+	// other and with the single shard locks without deadlocking.
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for n := 0; n < 50; n++ {
+				switch seed % 4 {
+				case 0:
+					mu.LockAll()
+					mu.UnlockAll()
+				case 1:
+					mu.RLockAll()
+					mu.RUnlockAll()
+				case 2:
+					keys := []uint{uint(rnd.Intn(shards)), uint(rnd.Intn(shards)), 3, 7}
+					mu.LockMany(keys...)
+					mu.UnlockMany(keys...)
+				default:
+					shard := uint(rnd.Intn(shards))
+					mu.Lock(shard)
+					mu.Unlock(shard)
+				}
+			}
+		}(int64(i))
+	}
+
+	assertCompletes(t, 10*time.Second, wg.Wait)
+	assert.Zero(t, mu.WriterCount())
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRLockMany(t *testing.T) {
+	var mu SMutex128
+	mu.RLockMany(2, 5, 5, 2)
+	for i := uint(0); i < shards; i++ {
+		switch i {
+		case 2, 5:
+			assert.Equal(t, int32(1), mu.mu[i].readers.Load())
+			assert.False(t, mu.TryLock(i))
+		default:
+			assert.Zero(t, mu.mu[i].readers.Load())
+		}
+	}
+
+	mu.RUnlockMany(5, 2)
+	assertCompletes(t, time.Second, func() {
+		mu.LockAll()
+		mu.UnlockAll()
+	})
+}
+
+func TestLockRange(t *testing.T) {
+	var mu SMutex128
+	mu.LockRange(4, 8)
+	for i := uint(0); i < shards; i++ {
+		assert.Equal(t, i >= 4 && i < 8, mu.IsLocked(i), "shard %d", i)
+	}
+
+	mu.UnlockRange(4, 8)
+	assert.Zero(t, mu.WriterCount())
+
+	mu.LockRange(0, shards)
+	assert.Equal(t, shards, mu.WriterCount())
+	mu.UnlockRange(0, shards)
+	mu.LockRange(3, 3)
+	assert.Zero(t, mu.WriterCount())
+}
+
+func TestLockRangeInvalid(t *testing.T) {
+	var mu SMutex128
+	assert.PanicsWithValue(t, "smutex: invalid shard range [8, 4)", func() { mu.LockRange(8, 4) })
+	assert.PanicsWithValue(t, "smutex: invalid shard range [0, 129)", func() { mu.LockRange(0, 129) })
+	assert.PanicsWithValue(t, "smutex: invalid shard range [0, 129)", func() { mu.UnlockRange(0, 129) })
+	assert.Zero(t, mu.WriterCount())
+}
+
+func TestLockSet(t *testing.T) {
+	var mu SMutex128
+	set := mu.LockSet()
+	set.Add(1)
+	set.Add(5)
+	set.Add(aliasOf(&mu, 5))
+	set.Add(1)
+
+	set.Acquire()
+	assert.Equal(t, 2, mu.WriterCount())
+	assert.True(t, mu.IsLocked(1))
+	assert.True(t, mu.IsLocked(5))
+	assert.PanicsWithValue(t, "smutex: Add to an acquired LockSet", func() { set.Add(2) })
+	assert.PanicsWithValue(t, "smutex: Acquire of an acquired LockSet", set.Acquire)
+
+	set.Release()
+	assert.Zero(t, mu.WriterCount())
+	assert.PanicsWithValue(t, "smutex: Release of an unacquired LockSet", set.Release)
+
+	// The set can be extended and acquired again
+	set.Add(2)
+	set.Acquire()
+	assert.Equal(t, 3, mu.WriterCount())
+	set.Release()
+}
+
+// aliasOf returns a key above the shard count which maps to the same shard as the key
+func aliasOf(mu *SMutex128, key uint) uint {
+	for k := uint(shards); ; k++ {
+		if mu.ShardOf(k) == mu.ShardOf(key) {
+			return k
+		}
+	}
+}
+
+func TestShardSet(t *testing.T) {
+	var set shardSet
+	for _, i := range []uint{127, 3, 64, 3, 0} {
+		set.add(i)
+	}
+
+	var out []uint
+	set.each(func(i uint) {
+		out = append(out, i)
+	})
+
+	assert.Equal(t, []uint{0, 3, 64, 127}, out)
+}
+
+// assertCompletes fails the test if fn does not return within the timeout
+func assertCompletes(t *testing.T, timeout time.Duration, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("deadlock detected")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+// Map represents a concurrent map which is split into as many shards as the mutex, each
+// one guarded by its own lock. A key is hashed once per operation and the resulting index
+// selects both the lock and the data shard. A zero value Map is empty and ready to use.
+type Map[K comparable, V any] struct {
+	mu   SMutex[K]
+	data [shards]map[K]V
+}
+
+// NewMap creates a new, empty concurrent map.
+func NewMap[K comparable, V any]() *Map[K, V] {
+	m := new(Map[K, V])
+	m.mu.once.Do(m.mu.init)
+	return m
+}
+
+// Get returns the value stored in the map for the key, and whether it was found.
+func (m *Map[K, V]) Get(key K) (value V, ok bool) {
+	i := m.shardOf(key)
+	m.mu.mu.rlockAt(i)
+	value, ok = m.data[i][key]
+	m.mu.mu.runlockAt(i)
+	return
+}
+
+// Set stores the value for the key, replacing any existing value.
+func (m *Map[K, V]) Set(key K, value V) {
+	i := m.shardOf(key)
+	m.mu.mu.lockAt(i)
+	if m.data[i] == nil {
+		m.data[i] = make(map[K]V)
+	}
+
+	m.data[i][key] = value
+	m.mu.mu.unlockAt(i)
+}
+
+// Delete removes the value stored for the key, if any.
+func (m *Map[K, V]) Delete(key K) {
+	i := m.shardOf(key)
+	m.mu.mu.lockAt(i)
+	delete(m.data[i], key)
+	m.mu.mu.unlockAt(i)
+}
+
+// Len returns the number of entries in the map. The shards are counted one after another,
+// so concurrent writes to the shards already counted are not reflected in the result.
+func (m *Map[K, V]) Len() (n int) {
+	for i := range m.data {
+		m.mu.mu.rlockAt(uint(i))
+		n += len(m.data[i])
+		m.mu.mu.runlockAt(uint(i))
+	}
+	return
+}
+
+// Range calls fn for every entry of the map, until fn returns false. Each shard is copied
+// under its read lock and fn is called once the lock is released, so fn may modify the
+// map. Every shard is a consistent snapshot, but the map as a whole is not.
+func (m *Map[K, V]) Range(fn func(key K, value V) bool) {
+	type entry struct {
+		key   K
+		value V
+	}
+
+	var snapshot []entry
+	for i := range m.data {
+		m.mu.mu.rlockAt(uint(i))
+		snapshot = snapshot[:0]
+		for k, v := range m.data[i] {
+			snapshot = append(snapshot, entry{key: k, value: v})
+		}
+		m.mu.mu.runlockAt(uint(i))
+
+		for _, e := range snapshot {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// shardOf returns the index of the shard which the key belongs to
+func (m *Map[K, V]) shardOf(key K) uint {
+	return m.mu.mu.ShardOf(m.mu.hash(key))
+}
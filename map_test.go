@@ -0,0 +1,86 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMap(t *testing.T) {
+	var m Map[string, int]
+	_, ok := m.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, m.Len())
+
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("a", 3)
+	v, ok := m.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, 2, m.Len())
+
+	m.Delete("a")
+	m.Delete("c")
+	_, ok = m.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestMapConcurrent(t *testing.T) {
+	const writers, keys = 8, 1000
+	m := NewMap[int, int]()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := w; k < keys; k += writers {
+				m.Set(k, k*2)
+				v, ok := m.Get(k)
+				assert.True(t, ok)
+				assert.Equal(t, k*2, v)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	assert.Equal(t, keys, m.Len())
+}
+
+func TestMapRange(t *testing.T) {
+	m := NewMap[int, int]()
+	for k := 0; k < 100; k++ {
+		m.Set(k, k)
+	}
+
+	// The callback runs outside of the locks, so it can modify the map
+	seen := make(map[int]int)
+	m.Range(func(k, v int) bool {
+		seen[k] = v
+		m.Delete(k)
+		return true
+	})
+	assert.Len(t, seen, 100)
+	assert.Equal(t, 42, seen[42])
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestMapRangeStop(t *testing.T) {
+	m := NewMap[int, int]()
+	for k := 0; k < 100; k++ {
+		m.Set(k, k)
+	}
+
+	count := 0
+	m.Range(func(k, v int) bool {
+		count++
+		return count < 10
+	})
+	assert.Equal(t, 10, count)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+// Namespace represents a view of a mutex shared by several data structures, where the
+// id of the namespace is mixed into the mapping of the keys to the shards.
+type Namespace struct {
+	rw   *SMutex128
+	salt uint // Offset added to every key, derived from the id
+}
+
+// Namespace returns a view of rw which shifts the shard of every key depending on the id,
+// so that several sharded maps can share the same mutex without the same key of every
+// map always landing on the same shard. This only reduces the contention between the
+// maps, as two keys of different namespaces can still map to the same shard. The
+// namespace 0 maps the keys exactly like rw itself.
+func (rw *SMutex128) Namespace(id uint) Namespace {
+	return Namespace{rw: rw, salt: uint(uint64(id) * 11400714819323198485)}
+}
+
+// ShardOf returns the index of the shard, in the range [0, Shards()), that the namespace
+// uses for the given key.
+func (n Namespace) ShardOf(key uint) uint {
+	return n.rw.ShardOf(key + n.salt)
+}
+
+// Lock locks the shard of the key for writing.
+func (n Namespace) Lock(key uint) {
+	n.rw.lockAt(n.ShardOf(key))
+}
+
+// TryLock tries to lock the shard of the key for writing and reports whether it succeeded.
+func (n Namespace) TryLock(key uint) bool {
+	return n.rw.tryLockAt(n.ShardOf(key))
+}
+
+// Unlock unlocks the shard of the key for writing.
+func (n Namespace) Unlock(key uint) {
+	n.rw.unlockAt(n.ShardOf(key))
+}
+
+// RLock locks the shard of the key for reading.
+func (n Namespace) RLock(key uint) {
+	n.rw.rlockAt(n.ShardOf(key))
+}
+
+// TryRLock tries to lock the shard of the key for reading and reports whether it succeeded.
+func (n Namespace) TryRLock(key uint) bool {
+	return n.rw.tryRLockAt(n.ShardOf(key))
+}
+
+// RUnlock unlocks the shard of the key for reading.
+func (n Namespace) RUnlock(key uint) {
+	n.rw.runlockAt(n.ShardOf(key))
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	var mu SMutex128
+	a, b := mu.Namespace(1), mu.Namespace(2)
+
+	a.Lock(5)
+	assert.True(t, mu.IsLocked(a.ShardOf(5)))
+	assert.False(t, a.TryRLock(5))
+	a.Unlock(5)
+
+	b.RLock(5)
+	assert.Equal(t, 1, mu.ReaderCount())
+	assert.True(t, b.TryRLock(5))
+	b.RUnlock(5)
+	b.RUnlock(5)
+	assert.True(t, b.TryLock(5))
+	b.Unlock(5)
+	assert.Zero(t, mu.WriterCount()+mu.ReaderCount())
+
+	// The namespace 0 behaves like the mutex itself
+	for key := uint(0); key < 1000; key++ {
+		assert.Equal(t, mu.ShardOf(key), mu.Namespace(0).ShardOf(key))
+	}
+}
+
+func TestNamespaceSpread(t *testing.T) {
+	var mu SMutex128
+	a, b := mu.Namespace(1), mu.Namespace(2)
+
+	same := 0
+	for key := uint(0); key < 1000; key++ {
+		if a.ShardOf(key) == b.ShardOf(key) {
+			same++
+		}
+	}
+	assert.Less(t, same, 100)
+}
@@ -0,0 +1,405 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Option represents an option which configures the sharded mutex.
+type Option func(*config)
+
+// config represents an optional configuration of the sharded mutex.
+type config struct {
+	stats   *[shards]counters           // Per-shard acquisition counters
+	hash    func(uint) uint             // Custom key mixing function
+	owners  *owners                     // Goroutines holding the shards for writing
+	waits   bool                        // Whether to measure the time spent waiting
+	fair    *[shards]turnstile          // Per-shard queues of waiting writers
+	timeout time.Duration               // Default timeout of LockOrFail and RLockOrFail
+	tracing bool                        // Whether to record the waits in the execution tracer
+	scans   *scans                      // Nesting depth of RLockAll for every goroutine
+	options []Option                    // Options the configuration was built from
+	name    string                      // Name of the mutex, used in panics and traces
+	bias    bool                        // Whether waiting writers let new readers in
+	order   *lockOrder                  // Shards held by every goroutine, in any mode
+	hook    func(op string, shard uint) // Called on every lock and unlock
+	holders *holders                    // Stack traces of the writers holding the shards
+	contend func(shard uint)            // Called when a lock has to wait
+	spins   int                         // Attempts of a writer before it parks
+}
+
+// New creates a new sharded mutex with the specified options. A zero value SMutex128
+// is also ready to use, and is equivalent to calling New without any options.
+func New(options ...Option) *SMutex128 {
+	rw := new(SMutex128)
+	if len(options) == 0 {
+		return rw
+	}
+
+	rw.cfg = &config{options: options}
+	for _, opt := range options {
+		opt(rw.cfg)
+	}
+	return rw
+}
+
+// Clone creates a new, unlocked sharded mutex with the same options as rw. None of the
+// state of rw is carried over, so the statistics of the clone start from zero.
+func (rw *SMutex128) Clone() *SMutex128 {
+	if rw.cfg == nil {
+		return New()
+	}
+	return New(rw.cfg.options...)
+}
+
+// WithStats enables per-shard counters of lock acquisitions, which can be retrieved
+// using the Stats() method. The counters are disabled by default.
+func WithStats() Option {
+	return func(c *config) {
+		if c.stats == nil {
+			c.stats = new([shards]counters)
+		}
+	}
+}
+
+// WithWaitTime measures, for every shard, the time spent blocked waiting for the lock in
+// Lock and RLock, and reports it as part of Stats(). The clock is only read when a lock
+// cannot be acquired right away. This option implies WithStats().
+func WithWaitTime() Option {
+	return func(c *config) {
+		WithStats()(c)
+		c.waits = true
+	}
+}
+
+// WithHash sets a function which mixes the keys before they are mapped to a shard, so
+// that the shard becomes h(key) % Shards(). This is useful when the keys are skewed and
+// would otherwise fall into only a few shards. The function must be pure, so the same
+// key always maps to the same shard, and fast since it is called on every lock.
+func WithHash(h func(key uint) uint) Option {
+	return func(c *config) {
+		c.hash = h
+	}
+}
+
+// WithDeadlockDetection records which goroutine holds each shard for writing, and makes
+// Lock panic instead of deadlocking when a goroutine locks a shard it already holds. An
+// RUnlock without a matching RLock then also panics with the index of the shard. It is
+// meant for debugging, since finding the current goroutine is slow.
+func WithDeadlockDetection() Option {
+	return func(c *config) {
+		c.owners = new(owners)
+	}
+}
+
+// WithFairness makes the writers waiting in Lock acquire each shard in the order they
+// arrived, so that no writer is starved under sustained contention. This trades some
+// throughput for a more predictable latency. TryLock, LockContext and TryLockFor never
+// join the queue and only succeed when no other writer is waiting for the shard.
+func WithFairness() Option {
+	return func(c *config) {
+		c.fair = new([shards]turnstile)
+	}
+}
+
+// WithDefaultTimeout sets how long LockOrFail and RLockOrFail wait for a shard before
+// giving up, which acts as a safety valve against runaway contention. Lock and RLock are
+// unaffected and keep blocking until the lock is available.
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithTracing records the time that Lock and RLock spend blocked as "smutex.Lock" and
+// "smutex.RLock" regions of the runtime/trace execution tracer, along with a "shard" log
+// message holding the index of the shard. Nothing is recorded unless tracing is started.
+func WithTracing() Option {
+	return func(c *config) {
+		c.tracing = true
+	}
+}
+
+// WithReentrantRLockAll makes RLockAll reentrant, so that a goroutine which already holds
+// RLockAll can call it again without touching the shards, and only the outermost pair of
+// RLockAll and RUnlockAll locks and unlocks them. A nested RLockAll therefore never gets
+// stuck behind a waiting writer. With this option, RUnlockAll must be called on the same
+// goroutine as the matching RLockAll, and finding the current goroutine is slow.
+func WithReentrantRLockAll() Option {
+	return func(c *config) {
+		c.scans = new(scans)
+	}
+}
+
+// WithReadBias favours readers for read-heavy workloads: a writer waiting in Lock polls
+// the shard, backing off between attempts, instead of queuing for it, so new readers are
+// only ever blocked by a writer which actually holds the shard. The downside is that a
+// shard which is never free of readers starves its writers indefinitely. It has no
+// effect if WithFairness() is also set, where writers always queue.
+func WithReadBias() Option {
+	return func(c *config) {
+		c.bias = true
+	}
+}
+
+// WithLockOrderCheck records the shards held by every goroutine, and makes Lock and RLock
+// panic when a goroutine waits for a shard while holding one with a higher index. Since
+// the multi-shard operations all lock in ascending order, this turns latent deadlocks
+// into immediate panics. It is meant for testing, as finding the current goroutine is
+// slow, and requires every shard to be unlocked by the goroutine which locked it.
+func WithLockOrderCheck() Option {
+	return func(c *config) {
+		c.order = new(lockOrder)
+	}
+}
+
+// WithAcquireHook sets a function which is called with the name of the operation, one of
+// "Lock", "Unlock", "RLock" and "RUnlock", and the index of the shard on every lock and
+// unlock of a shard, which lets tests record the exact sequence of operations. Locks are
+// reported once acquired and unlocks right before the shard is released, so the hook is
+// called while the shard is held. An Upgrade is reported as "RUnlock" and "Lock", and
+// a Downgrade as "Unlock" and "RLock". The hook must not lock the mutex itself.
+func WithAcquireHook(fn func(op string, shard uint)) Option {
+	return func(c *config) {
+		c.hook = fn
+	}
+}
+
+// WithHolderTracking records the stack trace of the goroutine holding each shard for
+// writing, so that Leaks() can report the shards held for longer than the threshold,
+// which helps finding a forgotten Unlock. It is disabled by default, as capturing a
+// stack trace on every Lock is slow.
+func WithHolderTracking(threshold time.Duration) Option {
+	return func(c *config) {
+		c.holders = &holders{threshold: threshold}
+	}
+}
+
+// WithContentionHook sets a function which is called with the index of the shard every
+// time Lock or RLock can not acquire it right away and has to wait. It is never called
+// on the fast path, so counting the calls gives the contention rate of every shard
+// without measuring any time. The hook must not lock the mutex itself.
+func WithContentionHook(fn func(shard uint)) Option {
+	return func(c *config) {
+		c.contend = fn
+	}
+}
+
+// WithSpin makes Lock retry to acquire a contended shard up to n times, yielding the
+// processor in between, before it parks the goroutine. This avoids the cost of parking
+// and waking up the writer when the shards are only held for very short periods of time,
+// but wastes CPU when they are held for longer.
+func WithSpin(n int) Option {
+	return func(c *config) {
+		c.spins = n
+	}
+}
+
+// WithName sets a name for the mutex, which is included in the panic messages and in
+// the execution traces recorded with WithTracing(), so that it is easy to tell which of
+// several mutexes misbehaved. For example, "smutex: Unlock of unlocked mutex" becomes
+// "smutex[orders]: Unlock of unlocked mutex" for a mutex named "orders".
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// rename must be deferred and re-panics with the name of the mutex in the message, if the
+// function panicked with one of the messages of the package.
+func (c *config) rename() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if msg, ok := r.(string); ok && strings.HasPrefix(msg, "smutex: ") {
+		panic("smutex[" + c.name + "]: " + strings.TrimPrefix(msg, "smutex: "))
+	}
+	panic(r)
+}
+
+// beforeLock is called before a shard is locked for writing
+func (c *config) beforeLock(i uint) {
+	if c.owners != nil {
+		c.owners.check(i)
+	}
+	if c.order != nil {
+		c.order.check(i)
+	}
+}
+
+// beforeRLock is called before a shard is locked for reading
+func (c *config) beforeRLock(i uint) {
+	if c.order != nil {
+		c.order.check(i)
+	}
+}
+
+// lock locks the shard for writing, going through the turnstile if fairness is enabled
+// and measuring how long it was blocked if the fast path failed.
+func (c *config) lock(s *shard, i uint) {
+	if c.tryLock(s, i) {
+		c.acquired(i, true)
+		return
+	}
+
+	c.acquired(i, false)
+
+	if c.contend != nil {
+		c.contend(i)
+	}
+	if c.tracing {
+		defer traceRegion("smutex.Lock", c.name, i).End()
+	}
+
+	var start time.Time
+	if c.waits {
+		start = time.Now()
+	}
+
+	switch {
+	case c.spin(s, i):
+	case c.fair != nil:
+		c.fair[i].lock(s)
+	case c.bias:
+		acquire(context.Background(), s.tryLock)
+	default:
+		s.lock()
+	}
+
+	if c.waits {
+		c.stats[i].wait.Add(int64(time.Since(start)))
+	}
+}
+
+// spin retries to lock the shard for writing as many times as set with WithSpin()
+func (c *config) spin(s *shard, i uint) bool {
+	for n := 0; n < c.spins; n++ {
+		runtime.Gosched()
+		if c.tryLock(s, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// tryLock tries to lock the shard for writing without blocking
+func (c *config) tryLock(s *shard, i uint) bool {
+	if c.fair != nil {
+		return c.fair[i].tryLock(s)
+	}
+	return s.tryLock()
+}
+
+// rlock locks the shard for reading, taking the slow path if it is not available
+func (c *config) rlock(s *shard, i uint) {
+	if s.tryRLock() {
+		c.acquired(i, true)
+		return
+	}
+
+	c.acquired(i, false)
+	c.rlockSlow(s, i)
+}
+
+// acquired counts a blocking acquisition of the shard, depending on whether it took the
+// fast path or had to wait.
+func (c *config) acquired(i uint, fast bool) {
+	switch {
+	case c.stats == nil:
+	case fast:
+		c.stats[i].fast.Add(1)
+	default:
+		c.stats[i].slow.Add(1)
+	}
+}
+
+// rlockSlow blocks until the shard is locked for reading, once the fast path failed
+func (c *config) rlockSlow(s *shard, i uint) {
+	if c.contend != nil {
+		c.contend(i)
+	}
+	if c.tracing {
+		defer traceRegion("smutex.RLock", c.name, i).End()
+	}
+
+	if !c.waits {
+		s.rlock()
+		return
+	}
+
+	start := time.Now()
+	s.rlock()
+	c.stats[i].wait.Add(int64(time.Since(start)))
+}
+
+// onLock is called once a shard was locked for writing
+func (c *config) onLock(i uint) {
+	if c.stats != nil {
+		c.stats[i].writes.Add(1)
+	}
+	if c.owners != nil {
+		c.owners.acquire(i)
+	}
+	if c.order != nil {
+		c.order.acquire(i)
+	}
+	if c.holders != nil {
+		c.holders.acquire(i)
+	}
+	if c.hook != nil {
+		c.hook("Lock", i)
+	}
+}
+
+// onUnlock is called before a shard is unlocked for writing
+func (c *config) onUnlock(i uint) {
+	if c.hook != nil {
+		c.hook("Unlock", i)
+	}
+	if c.owners != nil {
+		c.owners.release(i)
+	}
+	if c.fair != nil {
+		c.fair[i].release()
+	}
+	if c.order != nil {
+		c.order.release(i)
+	}
+	if c.holders != nil {
+		c.holders.release(i)
+	}
+}
+
+// onRLock is called once a shard was locked for reading
+func (c *config) onRLock(i uint) {
+	if c.stats != nil {
+		c.stats[i].reads.Add(1)
+	}
+	if c.order != nil {
+		c.order.acquire(i)
+	}
+	if c.hook != nil {
+		c.hook("RLock", i)
+	}
+}
+
+// beforeRUnlock is called before a shard is unlocked for reading
+func (c *config) beforeRUnlock(i uint) {
+	if c.hook != nil {
+		c.hook("RUnlock", i)
+	}
+}
+
+// onRUnlock is called once a shard was unlocked for reading
+func (c *config) onRUnlock(i uint) {
+	if c.order != nil {
+		c.order.release(i)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkReadBias(b *testing.B) {
+	for name, mu := range map[string]*SMutex128{
+		"default": New(),
+		"bias":    New(WithReadBias()),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(1))
+				for pb.Next() {
+					if rnd.Intn(100) < 5 {
+						mu.Lock(1)
+						runtime.Gosched()
+						mu.Unlock(1)
+						continue
+					}
+
+					mu.RLock(1)
+					runtime.Gosched()
+					mu.RUnlock(1)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSpin(b *testing.B) {
+	for _, spins := range []int{0, 30} {
+		mu := New(WithSpin(spins))
+		b.Run(fmt.Sprintf("spin=%d", spins), func(b *testing.B) {
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(1))
+				for pb.Next() {
+					if rnd.Intn(100) < 20 {
+						mu.Lock(1)
+						mu.Unlock(1)
+						continue
+					}
+
+					mu.RLock(1)
+					mu.RUnlock(1)
+				}
+			})
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	mu := New()
+	assert.Nil(t, mu.cfg)
+	assert.Equal(t, uint(shards), mu.Shards())
+	assert.Equal(t, uint(5), mu.ShardOf(5))
+
+	mu.Lock(1)
+	mu.Unlock(1)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	var applied []int
+	mu := New(
+		func(*config) { applied = append(applied, 1) },
+		func(*config) { applied = append(applied, 2) },
+	)
+
+	assert.NotNil(t, mu.cfg)
+	assert.Equal(t, []int{1, 2}, applied)
+	assert.Equal(t, uint(5), mu.ShardOf(5))
+}
+
+func TestClone(t *testing.T) {
+	mu := New(WithStats(), WithHash(func(k uint) uint { return k + 1 }))
+	mu.Lock(1)
+	defer mu.Unlock(1)
+
+	clone := mu.Clone()
+	assert.Equal(t, mu.Shards(), clone.Shards())
+	assert.Equal(t, uint(2), clone.ShardOf(1))
+	assert.Equal(t, make([]ShardStat, shards), clone.Stats())
+
+	// The clone is locked independently of the original
+	assert.True(t, clone.TryLock(1))
+	clone.Unlock(1)
+	assert.True(t, mu.IsLocked(1))
+}
+
+func TestCloneZero(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	defer mu.Unlock(1)
+
+	clone := mu.Clone()
+	assert.Nil(t, clone.cfg)
+	assert.True(t, clone.TryLock(1))
+	clone.Unlock(1)
+}
+
+func TestWithHash(t *testing.T) {
+	mu := New(WithHash(func(uint) uint { return 0 }))
+	for key := uint(0); key < 1000; key++ {
+		assert.Equal(t, uint(0), mu.ShardOf(key))
+	}
+
+	// Every key is serialized on the first shard
+	mu.Lock(1)
+	assert.False(t, mu.TryLock(2))
+	assert.False(t, mu.TryRLock(3))
+	mu.Unlock(1)
+	assert.True(t, mu.TryLock(2))
+	mu.Unlock(3)
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	mu := New(WithDefaultTimeout(20 * time.Millisecond))
+	assert.True(t, mu.LockOrFail(1))
+	assert.False(t, mu.LockOrFail(1))
+	assert.False(t, mu.RLockOrFail(1))
+	mu.Unlock(1)
+
+	assert.True(t, mu.RLockOrFail(1))
+	assert.False(t, mu.LockOrFail(1))
+	mu.RUnlock(1)
+}
+
+func TestWithoutDefaultTimeout(t *testing.T) {
+	var mu SMutex128
+	assert.True(t, mu.LockOrFail(1))
+	mu.Unlock(1)
+	assert.True(t, mu.RLockOrFail(1))
+	mu.RUnlock(1)
+}
+
+func TestWithName(t *testing.T) {
+	mu := New(WithName("orders"), WithDeadlockDetection())
+	assert.PanicsWithValue(t, "smutex[orders]: Unlock of unlocked mutex", func() {
+		mu.Unlock(1)
+	})
+	assert.PanicsWithValue(t, "smutex[orders]: RUnlock of unlocked shard 1", func() {
+		mu.RUnlock(1)
+	})
+	assert.PanicsWithValue(t, "smutex[orders]: UnlockAll of unlocked mutex", mu.UnlockAll)
+
+	mu.Lock(1)
+	assert.PanicsWithValue(t, "smutex[orders]: recursive Lock of shard 1", func() {
+		mu.Lock(1)
+	})
+	mu.Unlock(1)
+
+	// The mutex remains usable after the recovered panics
+	assert.True(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestWithReadBias(t *testing.T) {
+	for name, expect := range map[string]bool{"default": false, "bias": true} {
+		mu := New()
+		if expect {
+			mu = New(WithReadBias())
+		}
+
+		mu.RLock(1)
+		done := make(chan struct{})
+		go func() {
+			mu.Lock(1)
+			mu.Unlock(1)
+			close(done)
+		}()
+
+		// Give the writer time to start waiting for the shard
+		time.Sleep(10 * time.Millisecond)
+		ok := mu.TryRLock(1)
+		assert.Equal(t, expect, ok, name)
+		if ok {
+			mu.RUnlock(1)
+		}
+
+		mu.RUnlock(1)
+		<-done
+	}
+}
+
+func TestWithAcquireHook(t *testing.T) {
+	var log []string
+	mu := New(WithAcquireHook(func(op string, shard uint) {
+		log = append(log, fmt.Sprintf("%s(%d)", op, shard))
+	}))
+
+	mu.Lock(1)
+	mu.Unlock(1)
+	mu.RLock(2)
+	mu.RUnlock(2)
+	assert.False(t, mu.TryLock(3) && mu.TryLock(3))
+	mu.Unlock(3)
+	mu.RLock(4)
+	mu.Upgrade(4)
+	mu.Downgrade(4)
+	mu.RUnlock(4)
+
+	assert.Equal(t, []string{
+		"Lock(1)", "Unlock(1)",
+		"RLock(2)", "RUnlock(2)",
+		"Lock(3)", "Unlock(3)",
+		"RLock(4)", "RUnlock(4)", "Lock(4)", "Unlock(4)", "RLock(4)", "RUnlock(4)",
+	}, log)
+}
+
+func TestWithContentionHook(t *testing.T) {
+	contended := make(chan uint, 2)
+	mu := New(WithContentionHook(func(shard uint) {
+		contended <- shard
+	}))
+
+	// The fast path never calls the hook
+	mu.Lock(1)
+	mu.Unlock(1)
+	mu.RLock(1)
+	mu.RUnlock(1)
+	assert.Empty(t, contended)
+
+	mu.Lock(2)
+	done := make(chan struct{}, 2)
+	go func() {
+		mu.Lock(2)
+		mu.Unlock(2)
+		done <- struct{}{}
+	}()
+	go func() {
+		mu.RLock(2)
+		mu.RUnlock(2)
+		done <- struct{}{}
+	}()
+
+	assert.Equal(t, uint(2), <-contended)
+	assert.Equal(t, uint(2), <-contended)
+	mu.Unlock(2)
+	<-done
+	<-done
+}
+
+func TestWithSpin(t *testing.T) {
+	var contended int
+	mu := New(WithSpin(1000), WithContentionHook(func(uint) { contended++ }))
+
+	// A short-lived reader is waited out without parking the writer
+	mu.RLock(1)
+	go func() {
+		runtime.Gosched()
+		mu.RUnlock(1)
+	}()
+	mu.Lock(1)
+	assert.Equal(t, 1, contended)
+	assert.True(t, mu.IsLocked(1))
+	assert.Zero(t, mu.ReaderCount())
+	mu.Unlock(1)
+	assert.Zero(t, mu.WriterCount())
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "sync"
+
+// LockPriority locks rw for writing, just like Lock, but the writers waiting in
+// LockPriority for the same shard acquire it in order of their priority, the highest
+// first, and in arrival order for equal priorities. This is best-effort: the ordering
+// only applies among LockPriority callers, which still compete with the writers using
+// Lock, and the first caller to find no other LockPriority writer does not queue.
+func (rw *SMutex128) LockPriority(shard uint, priority int) {
+	i := rw.ShardOf(shard)
+	rw.queueAt(i).wait(priority)
+	rw.lockAt(i)
+	rw.mu[i].queue.Load().held = true
+}
+
+// queueAt returns the priority queue of the shard at index i, creating it if needed
+func (rw *SMutex128) queueAt(i uint) *priorityQueue {
+	if q := rw.mu[i].queue.Load(); q != nil {
+		return q
+	}
+
+	rw.mu[i].queue.CompareAndSwap(nil, new(priorityQueue))
+	return rw.mu[i].queue.Load()
+}
+
+// ------------------------------------------------------------------------------------
+
+// priorityQueue lets a single prioritized writer at a time go for the shard, and hands
+// the turn over to the waiter with the highest priority once it unlocks.
+type priorityQueue struct {
+	mu      sync.Mutex
+	busy    bool      // Whether a prioritized writer holds the turn
+	held    bool      // Whether the current writer holds the turn, only used by that writer
+	waiters []*waiter // Writers waiting for their turn, in arrival order
+}
+
+// waiter represents a prioritized writer waiting for its turn
+type waiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+// wait blocks until it is the turn of the caller
+func (q *priorityQueue) wait(priority int) {
+	q.mu.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mu.Unlock()
+		return
+	}
+
+	w := &waiter{priority: priority, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+	<-w.ready
+}
+
+// release hands the turn over to the waiter with the highest priority, it must be called
+// by the writer before the shard is unlocked.
+func (q *priorityQueue) release() {
+	if !q.held {
+		return // Acquired without going through the queue
+	}
+
+	q.held = false
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiters) == 0 {
+		q.busy = false
+		return
+	}
+
+	next := 0
+	for i, w := range q.waiters {
+		if w.priority > q.waiters[next].priority {
+			next = i
+		}
+	}
+
+	close(q.waiters[next].ready)
+	q.waiters = append(q.waiters[:next], q.waiters[next+1:]...)
+}
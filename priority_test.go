@@ -0,0 +1,66 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockPriority(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var order []int
+
+	mu.LockPriority(1, 0)
+	for i, priority := range []int{1, 10, 5, 10} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			mu.LockPriority(1, priority)
+			order = append(order, priority)
+			mu.Unlock(1)
+		}(priority)
+
+		// Wait for the writer to be queued before starting the next one
+		waitWaiters(mu.queueAt(1), i+1)
+	}
+
+	mu.Unlock(1)
+	assertCompletes(t, time.Second, wg.Wait)
+	assert.Equal(t, []int{10, 10, 5, 1}, order)
+}
+
+func TestLockPriorityMixed(t *testing.T) {
+	mu := New(WithStats())
+	mu.LockPriority(1, 0)
+	mu.Downgrade(1)
+	mu.RUnlock(1)
+
+	// Regular writers don't release the turn of the queue
+	mu.Lock(1)
+	mu.Unlock(1)
+	assertCompletes(t, time.Second, func() {
+		mu.LockPriority(1, 0)
+		mu.Unlock(1)
+	})
+	assert.Equal(t, uint64(3), mu.Stats()[1].Writes)
+}
+
+// waitWaiters waits until the queue holds at least the given number of waiters
+func waitWaiters(q *priorityQueue, n int) {
+	for {
+		q.mu.Lock()
+		count := len(q.waiters)
+		q.mu.Unlock()
+		if count >= n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import "sync"
+
+// scans tracks how many RLockAll calls are in effect on each goroutine
+type scans struct {
+	mu    sync.Mutex
+	depth map[int64]int
+}
+
+// enter records an RLockAll on the current goroutine and reports whether it is the
+// outermost one, which needs to actually lock the shards.
+func (s *scans) enter() bool {
+	id := goid()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.depth == nil {
+		s.depth = make(map[int64]int)
+	}
+
+	s.depth[id]++
+	return s.depth[id] == 1
+}
+
+// leave records an RUnlockAll on the current goroutine and reports whether it is the
+// outermost one, which needs to actually unlock the shards.
+func (s *scans) leave() bool {
+	id := goid()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.depth[id] {
+	case 0:
+		panic("smutex: RUnlockAll of unlocked mutex")
+	case 1:
+		delete(s.depth, id)
+		return true
+	default:
+		s.depth[id]--
+		return false
+	}
+}
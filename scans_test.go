@@ -0,0 +1,61 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReentrantRLockAll(t *testing.T) {
+	mu := New(WithReentrantRLockAll())
+	var written atomic.Bool
+	done := make(chan struct{})
+
+	mu.RLockAll()
+	go func() {
+		mu.Lock(5)
+		written.Store(true)
+		mu.Unlock(5)
+		close(done)
+	}()
+
+	// The nested scans don't churn the shards, even with a writer waiting on one
+	time.Sleep(5 * time.Millisecond)
+	mu.RLockAll()
+	mu.RLockAll()
+	assert.Equal(t, shards, mu.ReaderCount())
+	mu.RUnlockAll()
+	mu.RUnlockAll()
+
+	// The writer stays blocked for as long as the outer scan is held
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, written.Load())
+	assert.Equal(t, shards, mu.ReaderCount())
+
+	mu.RUnlockAll()
+	<-done
+	assert.True(t, written.Load())
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestReentrantRLockAllUnlocked(t *testing.T) {
+	mu := New(WithReentrantRLockAll())
+	assert.PanicsWithValue(t, "smutex: RUnlockAll of unlocked mutex", mu.RUnlockAll)
+
+	// Another goroutine's scan is not released by this one
+	done := make(chan struct{})
+	mu.RLockAll()
+	go func() {
+		defer close(done)
+		assert.PanicsWithValue(t, "smutex: RUnlockAll of unlocked mutex", mu.RUnlockAll)
+	}()
+
+	<-done
+	mu.RUnlockAll()
+	assert.Zero(t, mu.ReaderCount())
+}
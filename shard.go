@@ -0,0 +1,184 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// shard represents a single RWMutex along with the bookkeeping needed to detect misuse,
+// padded to a full cache line on every architecture to prevent false sharing.
+type shard struct {
+	shardFields
+	_ [64 - unsafe.Sizeof(shardFields{})%64]byte
+}
+
+// shardFields represents the fields of a shard, without the padding
+type shardFields struct {
+	sync.RWMutex
+	writer  atomic.Uint32                 // Whether the shard is locked for writing
+	readers atomic.Int32                  // Number of readers currently holding the shard
+	pinned  atomic.Pointer[chan struct{}] // Closed once an upgrade or downgrade completes
+	cond    atomic.Pointer[sync.Cond]     // Condition variable, created on first Wait
+	queue   atomic.Pointer[priorityQueue] // Prioritized writers, created on first use
+}
+
+// lock locks the shard for writing
+func (s *shard) lock() {
+	s.RWMutex.Lock()
+	for pin := s.pinned.Load(); pin != nil; pin = s.pinned.Load() {
+		s.RWMutex.Unlock()
+		<-*pin
+		s.RWMutex.Lock()
+	}
+
+	s.writer.Store(1)
+}
+
+// tryLock tries to lock the shard for writing
+func (s *shard) tryLock() bool {
+	if !s.RWMutex.TryLock() {
+		return false
+	}
+
+	if s.pinned.Load() != nil {
+		s.RWMutex.Unlock()
+		return false
+	}
+
+	s.writer.Store(1)
+	return true
+}
+
+// upgrade converts a read lock on the shard into a write lock. The shard is pinned while
+// the other readers drain so that regular writers park until it is unpinned, which makes
+// the upgrade atomic. If another reader is already upgrading, the read lock is released and a
+// regular write lock is acquired instead, in which case upgrade returns false. The read
+// lock is checked before pinning, so misuse never leaves the shard pinned.
+func (s *shard) upgrade() bool {
+	if s.readers.Add(-1) < 0 {
+		s.readers.Add(1)
+		panic("smutex: Upgrade of unlocked mutex")
+	}
+
+	if !s.pin() {
+		s.RWMutex.RUnlock()
+		s.lock()
+		return false
+	}
+
+	s.RWMutex.RUnlock()
+	s.RWMutex.Lock()
+	s.writer.Store(1)
+	s.unpin()
+	return true
+}
+
+// tryUpgrade converts a read lock on the shard into a write lock, but only if the caller
+// is the only reader and no other reader is upgrading. The shard is pinned while the read
+// lock is swapped for the write lock, so that no writer gets in between. If a reader or a
+// writer shows up meanwhile, the read lock is taken back and tryUpgrade returns false.
+func (s *shard) tryUpgrade() bool {
+	if s.readers.Add(-1) < 0 {
+		s.readers.Add(1)
+		panic("smutex: TryUpgrade of unlocked mutex")
+	}
+
+	if s.readers.Load() != 0 || !s.pin() {
+		s.readers.Add(1)
+		return false
+	}
+
+	s.RWMutex.RUnlock()
+	if s.RWMutex.TryLock() {
+		s.writer.Store(1)
+		s.unpin()
+		return true
+	}
+
+	s.rlock()
+	s.unpin()
+	return false
+}
+
+// unlock unlocks the shard for writing
+func (s *shard) unlock() {
+	if !s.writer.CompareAndSwap(1, 0) {
+		panic("smutex: Unlock of unlocked mutex")
+	}
+
+	if q := s.queue.Load(); q != nil {
+		q.release()
+	}
+
+	s.RWMutex.Unlock()
+}
+
+// downgrade converts a write lock on the shard into a read lock. The shard is pinned
+// while the write lock is released, so that no other writer can acquire it in between.
+// The write lock is checked before pinning, so misuse never leaves the shard pinned.
+func (s *shard) downgrade() {
+	if !s.writer.CompareAndSwap(1, 0) {
+		panic("smutex: Downgrade of unlocked mutex")
+	}
+
+	if q := s.queue.Load(); q != nil {
+		q.release()
+	}
+
+	s.pin()
+	s.RWMutex.Unlock()
+	s.rlock()
+	s.unpin()
+}
+
+// pin reserves the shard so that regular writers park until unpin is called. It returns
+// false if the shard is already pinned.
+func (s *shard) pin() bool {
+	done := make(chan struct{})
+	return s.pinned.CompareAndSwap(nil, &done)
+}
+
+// unpin releases the reservation and wakes up the parked writers
+func (s *shard) unpin() {
+	close(*s.pinned.Swap(nil))
+}
+
+// rlock locks the shard for reading
+func (s *shard) rlock() {
+	s.RWMutex.RLock()
+	s.readers.Add(1)
+}
+
+// tryRLock tries to lock the shard for reading
+func (s *shard) tryRLock() bool {
+	if !s.RWMutex.TryRLock() {
+		return false
+	}
+
+	s.readers.Add(1)
+	return true
+}
+
+// runlock unlocks the shard for reading
+func (s *shard) runlock() {
+	if s.readers.Add(-1) < 0 {
+		s.readers.Add(1)
+		panic("smutex: RUnlock of unlocked mutex")
+	}
+
+	s.RWMutex.RUnlock()
+}
+
+// noCopy may be embedded into structs which must not be copied after the first use, so
+// that the copylocks checker of "go vet" reports accidental copies.
+type noCopy struct{}
+
+// Lock is a no-op used by the copylocks checker of "go vet".
+func (*noCopy) Lock() {}
+
+// Unlock is a no-op used by the copylocks checker of "go vet".
+func (*noCopy) Unlock() {}
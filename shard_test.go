@@ -0,0 +1,43 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkDistinct(b *testing.B) {
+	b.Run("unpadded", func(b *testing.B) {
+		var mu [shards]sync.RWMutex
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			i := next.Add(1) % shards
+			for pb.Next() {
+				mu[i].Lock()
+				mu[i].Unlock()
+			}
+		})
+	})
+
+	b.Run("padded", func(b *testing.B) {
+		var mu [shards]shard
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			i := next.Add(1) % shards
+			for pb.Next() {
+				mu[i].RWMutex.Lock()
+				mu[i].RWMutex.Unlock()
+			}
+		})
+	})
+}
+
+func TestShardSize(t *testing.T) {
+	assert.Equal(t, uintptr(64), unsafe.Sizeof(shard{}))
+}
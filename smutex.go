@@ -3,38 +3,646 @@
 
 package smutex
 
-import "sync"
+import (
+	"context"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-const shards = 128
+const (
+	shards    = 128
+	shardBits = 7 // log2(shards), used by the fibonacci hash
+)
+
+const (
+	spinCount = 4                     // Number of yields before sleeping
+	minDelay  = 10 * time.Microsecond // Initial sleep between attempts
+	maxDelay  = 1 * time.Millisecond  // Maximum sleep between attempts
+)
 
 // SMutex128 represents a sharded RWMutex that supports finer-granularity concurrency
 // contron hence reducing potential contention.
 type SMutex128 struct {
-	mu [shards]struct {
-		sync.RWMutex
-		_ [40]byte // Padding to prevent false sharing
+	noCopy   noCopy
+	mu       [shards]shard
+	cfg      *config      // Optional configuration, nil by default
+	scanning atomic.Int32 // Number of RLockAll regions in progress
+	closed   atomic.Bool  // Whether Close was called
+}
+
+// Shards returns the number of shards of the mutex.
+func (rw *SMutex128) Shards() uint {
+	return shards
+}
+
+// SuggestShards returns a recommended, power-of-two number of shards for the expected
+// number of goroutines contending for the lock, or GOMAXPROCS if parallelism is not
+// positive. It follows the rule of thumb of four shards per goroutine, capped to the
+// number of shards that SMutex128 provides, which tells how many distinct keys or shard
+// indices are worth spreading the protected resources over.
+func SuggestShards(parallelism int) uint {
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+
+	n := uint(parallelism) * 4
+	if n >= shards {
+		return shards
+	}
+	return 1 << bits.Len(n-1)
+}
+
+// ShardOf returns the index of the shard, in the range [0, Shards()), that the mutex
+// uses for the given key. Keys below Shards() map to the shard of the same index, while
+// the higher bits of larger keys are mixed in with a fibonacci hash, so that keys which
+// are multiples of the shard count do not all end up in the same shard.
+func (rw *SMutex128) ShardOf(key uint) uint {
+	if rw.cfg != nil && rw.cfg.hash != nil {
+		return rw.cfg.hash(key) % shards
+	}
+	return shardOf(key)
+}
+
+// shardOf maps the key to a shard, mixing the higher bits of the key in
+func shardOf(key uint) uint {
+	return (key + mix(key>>shardBits)) % shards
+}
+
+// mix hashes the key with fibonacci hashing, keeping the top bits of the product with
+// the golden ratio since they depend on every bit of the key. Zero maps to zero.
+func mix(key uint) uint {
+	return uint((uint64(key) * 11400714819323198485) >> (64 - shardBits))
+}
+
+// IsLocked reports whether the shard is currently locked for writing. The result may
+// be stale by the time it is returned, so it should only be used as a diagnostic aid
+// and never for synchronization.
+func (rw *SMutex128) IsLocked(shard uint) bool {
+	return rw.mu[rw.ShardOf(shard)].writer.Load() == 1
+}
+
+// WriterCount returns the number of shards currently locked for writing. The shards are
+// read one after another without any synchronization, so the result is only a best-effort
+// diagnostic which may be stale or inconsistent by the time it is returned.
+func (rw *SMutex128) WriterCount() int {
+	n := 0
+	for i := range rw.mu {
+		n += int(rw.mu[i].writer.Load())
+	}
+	return n
+}
+
+// ReaderCount returns the number of read locks currently held across all of the shards.
+// Just like WriterCount, the result is only a best-effort diagnostic.
+func (rw *SMutex128) ReaderCount() int {
+	n := 0
+	for i := range rw.mu {
+		n += int(rw.mu[i].readers.Load())
+	}
+	return n
+}
+
+// IsRLockAllActive reports whether some goroutine currently holds every shard for reading
+// through RLockAll or RLockAllContext. Just like WriterCount, the result is only a
+// best-effort diagnostic.
+func (rw *SMutex128) IsRLockAllActive() bool {
+	return rw.scanning.Load() > 0
+}
+
+// WaitForWriters blocks until none of the shards is locked for writing, parking on the
+// shards which have a writer rather than polling them. No lock is held once it returns,
+// so the writers may resume right away, and every shard was free at some point during
+// the call but not necessarily all at once. This makes it a cheap, heuristic check for
+// quiescence, weaker than RLockAll.
+func (rw *SMutex128) WaitForWriters() {
+	for i := range rw.mu {
+		if s := &rw.mu[i]; s.writer.Load() == 1 {
+			s.RWMutex.RLock()
+			s.RWMutex.RUnlock()
+		}
 	}
 }
 
 // Lock locks rw for writing. If the lock is already locked for reading or writing,
 // then Lock blocks until the lock is available.
 func (rw *SMutex128) Lock(shard uint) {
-	rw.mu[shard%shards].Lock()
+	rw.lockAt(rw.ShardOf(shard))
+}
+
+// TryLock tries to lock rw for writing and reports whether it succeeded. It never
+// blocks and returns false immediately if the shard is locked for reading or writing.
+// This mirrors sync.RWMutex.TryLock, except that it also fails while a reader upgrades
+// the shard or, with WithFairness(), while other writers are queued for it.
+func (rw *SMutex128) TryLock(shard uint) bool {
+	return rw.tryLockAt(rw.ShardOf(shard))
+}
+
+// LockContext locks rw for writing, blocking until the lock is available or the context
+// is done. If the context is done first, the lock is not acquired and ctx.Err() is returned.
+func (rw *SMutex128) LockContext(ctx context.Context, shard uint) error {
+	if rw.closed.Load() {
+		return ErrClosed
+	}
+
+	i := rw.ShardOf(shard)
+	return acquire(ctx, func() bool {
+		return rw.tryLockAt(i)
+	})
 }
 
-// Unlock unlocks rw for writing. It is a run-time error if rw is not locked for
-// writing on entry to Unlock.
+// TryLockFor tries to lock rw for writing, waiting up to the specified duration for the
+// lock to become available. It reports whether the lock was acquired.
+func (rw *SMutex128) TryLockFor(shard uint, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return rw.LockContext(ctx, shard) == nil
+}
+
+// LockOrFail locks rw for writing, waiting up to the timeout set with WithDefaultTimeout()
+// for the lock to become available. It reports whether the lock was acquired. Without a
+// default timeout, it blocks just like Lock and always returns true.
+func (rw *SMutex128) LockOrFail(shard uint) bool {
+	if rw.cfg == nil || rw.cfg.timeout <= 0 {
+		rw.Lock(shard)
+		return true
+	}
+
+	return rw.TryLockFor(shard, rw.cfg.timeout)
+}
+
+// LockAll locks every shard of rw for writing. Shards are always acquired in ascending
+// order, so LockAll never deadlocks against callers that hold a single shard or that
+// acquire several shards in the same ascending order.
+func (rw *SMutex128) LockAll() {
+	for i := range rw.mu {
+		rw.lockAt(uint(i))
+	}
+}
+
+// TryLockAll tries to lock every shard of rw for writing without blocking, in ascending
+// order, and reports whether it succeeded. If any of the shards is busy, the shards which
+// were already acquired are released in the reverse order and it returns false, so either
+// all of the shards are locked or none of them is. Unlock them with UnlockAll.
+func (rw *SMutex128) TryLockAll() bool {
+	for i := uint(0); i < shards; i++ {
+		if rw.tryLockAt(i) {
+			continue
+		}
+
+		for j := int(i) - 1; j >= 0; j-- {
+			rw.unlockAt(uint(j))
+		}
+		return false
+	}
+	return true
+}
+
+// Unlock unlocks rw for writing. It panics if rw is not locked for writing on entry
+// to Unlock.
 func (rw *SMutex128) Unlock(shard uint) {
-	rw.mu[shard%shards].Unlock()
+	rw.unlockAt(rw.ShardOf(shard))
+}
+
+// UnlockAll unlocks every shard of rw for writing, in the reverse order of LockAll. It
+// panics if any of the shards is not locked for writing on entry to UnlockAll.
+func (rw *SMutex128) UnlockAll() {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	for i := range rw.mu {
+		if rw.mu[i].writer.Load() == 0 {
+			panic("smutex: UnlockAll of unlocked mutex")
+		}
+	}
+
+	for i := len(rw.mu) - 1; i >= 0; i-- {
+		rw.unlockAt(uint(i))
+	}
 }
 
 // RLock locks rw for reading. It should not be used for recursive read locking; a
 // blocked Lock call excludes new readers from acquiring the lock.
 func (rw *SMutex128) RLock(shard uint) {
-	rw.mu[shard%shards].RLock()
+	rw.rlockAt(rw.ShardOf(shard))
+}
+
+// TryRLock tries to lock rw for reading and reports whether it succeeded. It never
+// blocks and returns false immediately if the shard is locked or awaited by a writer,
+// exactly like sync.RWMutex.TryRLock.
+func (rw *SMutex128) TryRLock(shard uint) bool {
+	return rw.tryRLockAt(rw.ShardOf(shard))
+}
+
+// RLockContext locks rw for reading, blocking until the lock is available or the context
+// is done. If the context is done first, the lock is not acquired and ctx.Err() is returned.
+func (rw *SMutex128) RLockContext(ctx context.Context, shard uint) error {
+	if rw.closed.Load() {
+		return ErrClosed
+	}
+
+	i := rw.ShardOf(shard)
+	return acquire(ctx, func() bool {
+		return rw.tryRLockAt(i)
+	})
+}
+
+// RLockOrFail locks rw for reading, waiting up to the timeout set with WithDefaultTimeout()
+// for the lock to become available. It reports whether the lock was acquired. Without a
+// default timeout, it blocks just like RLock and always returns true.
+func (rw *SMutex128) RLockOrFail(shard uint) bool {
+	if rw.cfg == nil || rw.cfg.timeout <= 0 {
+		rw.RLock(shard)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rw.cfg.timeout)
+	defer cancel()
+	return rw.RLockContext(ctx, shard) == nil
+}
+
+// RLockSpin tries to lock rw for reading, retrying up to spins more times if the first
+// attempt fails and yielding the processor in between, without ever parking. It reports
+// whether the lock was acquired, and is meant for shards which are only held very briefly.
+func (rw *SMutex128) RLockSpin(shard uint, spins int) bool {
+	i := rw.ShardOf(shard)
+	for n := 0; ; n++ {
+		if rw.tryRLockAt(i) {
+			return true
+		}
+		if n >= spins {
+			return false
+		}
+		runtime.Gosched()
+	}
 }
 
-// RUnlock undoes a single RLock call and does not affect other simultaneous readers.
+// RUnlock undoes a single RLock call and does not affect other simultaneous readers. It
+// panics if rw is not locked for reading on entry to RUnlock.
 func (rw *SMutex128) RUnlock(shard uint) {
-	rw.mu[shard%shards].RUnlock()
+	rw.runlockAt(rw.ShardOf(shard))
+}
+
+// RLockAll locks every shard of rw for reading, in ascending order. Once it returns, no
+// writer can hold any of the shards until RUnlockAll is called. At the lock level, a
+// blocked RLockAll is not starved by writers: once its read lock is waiting on a shard,
+// the current writer of that shard releases it to the waiting readers before the next
+// writer gets in. This says nothing about scheduling, as the woken goroutine still has
+// to wait for a processor. With few processors and writers that never yield, that wait
+// can last a full scheduler time slice per shard. Concurrent RLockAll calls never block
+// each other for good, since readers share the shards and they are all taken in order.
+//
+// RLockAll only excludes writers: readers of single shards on other goroutines coexist
+// with it. While RLockAll is held, RLock and RUnlock of a single shard take and release an
+// extra read lock, which never releases the one held by RLockAll. Like any recursive read lock
+// though, RLock deadlocks if a writer is already waiting for that shard, so nested reads
+// should either rely on the RLockAll hold directly or use TryRLock.
+//
+// The ascending order is required even when the writers cluster on a few shards, since
+// LockMany, LockAll and the other multi-shard locks take the shards in the same order.
+// Taking a busy shard before a free one could deadlock against a writer holding the free
+// shard while it waits for the busy one.
+func (rw *SMutex128) RLockAll() {
+	if rw.cfg != nil && rw.cfg.scans != nil && !rw.cfg.scans.enter() {
+		return // Already held by this goroutine
+	}
+
+	for i := range rw.mu {
+		rw.rlockAt(uint(i))
+	}
+	rw.scanning.Add(1)
+}
+
+// RLockAllContext locks every shard of rw for reading, just like RLockAll, but gives up
+// once the context is done. In that case, the read locks already acquired are released
+// and ctx.Err() is returned, so that a stuck writer can't block a full scan forever.
+func (rw *SMutex128) RLockAllContext(ctx context.Context) error {
+	if rw.closed.Load() {
+		return ErrClosed
+	}
+
+	if rw.cfg != nil && rw.cfg.scans != nil && !rw.cfg.scans.enter() {
+		return nil // Already held by this goroutine
+	}
+
+	for i := uint(0); i < shards; i++ {
+		if rw.tryRLockAt(i) {
+			continue
+		}
+
+		if err := acquire(ctx, func() bool { return rw.tryRLockAt(i) }); err != nil {
+			for j := int(i) - 1; j >= 0; j-- {
+				rw.runlockAt(uint(j))
+			}
+			if rw.cfg != nil && rw.cfg.scans != nil {
+				rw.cfg.scans.leave()
+			}
+			return err
+		}
+	}
+	rw.scanning.Add(1)
+	return nil
+}
+
+// RLockAllFunc locks every shard of rw for reading, just like RLockAll, and returns a
+// function which releases them. The release function is safe to call more than once,
+// only the first call has an effect, which allows writing "defer rw.RLockAllFunc()()".
+func (rw *SMutex128) RLockAllFunc() (release func()) {
+	rw.RLockAll()
+	var once sync.Once
+	return func() {
+		once.Do(rw.RUnlockAll)
+	}
+}
+
+// RUnlockAll undoes a single RLockAll call, releasing the shards in the reverse order
+// they were acquired. It must be called exactly once after a successful RLockAll.
+func (rw *SMutex128) RUnlockAll() {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	if rw.cfg != nil && rw.cfg.scans != nil && !rw.cfg.scans.leave() {
+		return // Still held by an outer RLockAll
+	}
+
+	rw.scanning.Add(-1)
+	for i := len(rw.mu) - 1; i >= 0; i-- {
+		rw.runlockAt(uint(i))
+	}
+}
+
+// Range calls fn for every shard in ascending order, holding only the read lock of that
+// shard during the call. Unlike RLockAll, the shards are never all locked at once, so the
+// writers of the other shards can proceed while fn runs. Each shard is consistent on its
+// own, but a full scan is not a consistent snapshot of all shards.
+func (rw *SMutex128) Range(fn func(shard uint)) {
+	for i := uint(0); i < shards; i++ {
+		rw.rlockRange(i, fn)
+	}
+}
+
+// rlockRange calls fn with the read lock of the shard at index i held, releasing it even
+// if fn panics.
+func (rw *SMutex128) rlockRange(i uint, fn func(shard uint)) {
+	rw.rlockAt(i)
+	defer rw.runlockAt(i)
+	fn(i)
+}
+
+// ForEachWrite calls fn for every shard in ascending order, holding only the write lock
+// of that shard during the call. It is the mutating counterpart of Range, useful for a
+// compaction pass which works on one shard at a time. If fn panics, the shard is unlocked
+// and the panic propagates without visiting the remaining shards.
+func (rw *SMutex128) ForEachWrite(fn func(shard uint)) {
+	for i := uint(0); i < shards; i++ {
+		rw.lockForEach(i, fn)
+	}
+}
+
+// lockForEach calls fn with the write lock of the shard at index i held, releasing it
+// even if fn panics.
+func (rw *SMutex128) lockForEach(i uint, fn func(shard uint)) {
+	rw.lockAt(i)
+	defer rw.unlockAt(i)
+	fn(i)
+}
+
+// Upgrade converts a read lock held on the shard into a write lock, blocking until the
+// other readers release the shard. It returns true if no other writer acquired the shard
+// in between, so whatever was read under the read lock is still valid. If another reader
+// is concurrently upgrading the same shard, that reader proceeds first and Upgrade returns
+// false once the write lock is acquired, meaning that the caller must read again.
+func (rw *SMutex128) Upgrade(shard uint) bool {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	i := rw.ShardOf(shard)
+	ok := rw.mu[i].upgrade()
+	if rw.cfg != nil {
+		rw.cfg.beforeRUnlock(i)
+		rw.cfg.onRUnlock(i)
+		rw.cfg.onLock(i)
+	}
+	return ok
+}
+
+// TryUpgrade converts a read lock held on the shard into a write lock without blocking,
+// which only succeeds if the caller is the only reader of the shard. It reports whether
+// the write lock was acquired, in which case no other writer acquired the shard in
+// between. Otherwise the read lock is still held, and the caller may release it and
+// retry from scratch, which avoids two readers waiting for each other to upgrade.
+func (rw *SMutex128) TryUpgrade(shard uint) bool {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	i := rw.ShardOf(shard)
+	if !rw.mu[i].tryUpgrade() {
+		return false
+	}
+
+	if rw.cfg != nil {
+		rw.cfg.beforeRUnlock(i)
+		rw.cfg.onRUnlock(i)
+		rw.cfg.onLock(i)
+	}
+	return true
+}
+
+// Downgrade converts a write lock held on the shard into a read lock, letting other
+// readers in while guaranteeing that no other writer acquires the shard in between.
+func (rw *SMutex128) Downgrade(shard uint) {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	i := rw.ShardOf(shard)
+	if rw.cfg != nil {
+		rw.cfg.onUnlock(i)
+	}
+
+	rw.mu[i].downgrade()
+	if rw.cfg != nil {
+		rw.cfg.onRLock(i)
+	}
+}
+
+// WithLock locks the shard for writing, calls fn and unlocks the shard once fn returns,
+// even if fn panics.
+func (rw *SMutex128) WithLock(shard uint, fn func()) {
+	rw.Lock(shard)
+	defer rw.Unlock(shard)
+	fn()
+}
+
+// WithRLock locks the shard for reading, calls fn and unlocks the shard once fn returns,
+// even if fn panics.
+func (rw *SMutex128) WithRLock(shard uint, fn func()) {
+	rw.RLock(shard)
+	defer rw.RUnlock(shard)
+	fn()
+}
+
+// WithSnapshot locks every shard for reading, calls fn and unlocks the shards in the
+// reverse order once fn returns, even if fn panics. No writer holds any of the shards
+// while fn runs, so it observes a consistent view across all of them, which is useful
+// to take a backup of sharded data.
+func (rw *SMutex128) WithSnapshot(fn func()) {
+	rw.RLockAll()
+	defer rw.RUnlockAll()
+	fn()
+}
+
+// lockAt locks the shard at index i for writing
+func (rw *SMutex128) lockAt(i uint) {
+	if rw.closed.Load() {
+		rw.panicClosed("Lock")
+	}
+
+	if rw.cfg == nil {
+		rw.mu[i].lock()
+		return
+	}
+
+	if rw.cfg.name != "" {
+		defer rw.cfg.rename()
+	}
+
+	rw.cfg.beforeLock(i)
+	rw.cfg.lock(&rw.mu[i], i)
+	rw.cfg.onLock(i)
+}
+
+// tryLockAt tries to lock the shard at index i for writing
+func (rw *SMutex128) tryLockAt(i uint) bool {
+	if rw.closed.Load() {
+		return false
+	}
+
+	if rw.cfg == nil {
+		return rw.mu[i].tryLock()
+	}
+
+	if !rw.cfg.tryLock(&rw.mu[i], i) {
+		return false
+	}
+
+	rw.cfg.onLock(i)
+	return true
+}
+
+// unlockAt unlocks the shard at index i for writing
+func (rw *SMutex128) unlockAt(i uint) {
+	if rw.cfg != nil {
+		if rw.cfg.name != "" {
+			defer rw.cfg.rename()
+		}
+		rw.cfg.onUnlock(i)
+	}
+
+	rw.mu[i].unlock()
+}
+
+// rlockAt locks the shard at index i for reading
+func (rw *SMutex128) rlockAt(i uint) {
+	if rw.closed.Load() {
+		rw.panicClosed("RLock")
+	}
+
+	if rw.cfg == nil {
+		rw.mu[i].rlock()
+		return
+	}
+
+	if rw.cfg.name != "" {
+		defer rw.cfg.rename()
+	}
+
+	rw.cfg.beforeRLock(i)
+	rw.cfg.rlock(&rw.mu[i], i)
+	rw.cfg.onRLock(i)
+}
+
+// tryRLockAt tries to lock the shard at index i for reading
+func (rw *SMutex128) tryRLockAt(i uint) bool {
+	if rw.closed.Load() || !rw.mu[i].tryRLock() {
+		return false
+	}
+
+	if rw.cfg != nil {
+		rw.cfg.onRLock(i)
+	}
+	return true
+}
+
+// runlockAt unlocks the shard at index i for reading
+func (rw *SMutex128) runlockAt(i uint) {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	if rw.cfg != nil {
+		if rw.cfg.owners != nil {
+			rw.cfg.owners.checkRUnlock(&rw.mu[i], i)
+		}
+		rw.cfg.beforeRUnlock(i)
+	}
+
+	rw.mu[i].runlock()
+	if rw.cfg != nil {
+		rw.cfg.onRUnlock(i)
+	}
+}
+
+// named reports whether the mutex was given a name with WithName()
+func (rw *SMutex128) named() bool {
+	return rw.cfg != nil && rw.cfg.name != ""
+}
+
+// acquire repeatedly calls try until it succeeds or the context is done. It first
+// yields the processor a few times and then backs off exponentially, so an abandoned
+// attempt never leaves a pending lock behind. Each sleep is randomly jittered, so that
+// waiters which started together don't keep retrying in lockstep.
+func acquire(ctx context.Context, try func() bool) error {
+	for i := 0; i < spinCount; i++ {
+		if try() {
+			return nil
+		}
+		runtime.Gosched()
+	}
+
+	delay := minDelay
+	seed := uint64(time.Now().UnixNano()) | 1
+	timer := time.NewTimer(jitter(delay, &seed))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			if try() {
+				return nil
+			}
+
+			if delay < maxDelay {
+				delay *= 2
+			}
+			timer.Reset(jitter(delay, &seed))
+		}
+	}
+}
+
+// jitter returns a random duration in the range [delay/2, delay), advancing the state of
+// a xorshift generator, which is cheaper than a shared random source and never contends.
+func jitter(delay time.Duration, state *uint64) time.Duration {
+	*state ^= *state << 13
+	*state ^= *state >> 7
+	*state ^= *state << 17
+	half := uint64(delay / 2)
+	return time.Duration(half + *state%half)
 }
@@ -4,11 +4,15 @@
 package smutex
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,76 +26,1475 @@ type Store interface {
 func BenchmarkLock(b *testing.B) {
 	size := int64(10000000)
 
-	single := newLocked()
+	// Low parallelism first, to find where sharding starts to pay off, then high
+	procs := []int64{1, 2, 4, 8, 16}
 	for i := int64(64); i <= (1 << 16); i *= 4 {
-		runBenchmark(b, "single", single, size, i)
+		procs = append(procs, i)
+	}
+
+	single := newLocked()
+	for _, n := range procs {
+		runBenchmark(b, "single", single, size, n)
+	}
+
+	sharded := newSharded()
+	for _, n := range procs {
+		runBenchmark(b, "sharded", sharded, size, n)
+	}
+
+	syncmap := new(syncMap)
+	for _, n := range procs {
+		runBenchmark(b, "syncmap", syncmap, size, n)
+	}
+}
+
+func BenchmarkLockUnlock(b *testing.B) {
+	b.Run("rwmutex", func(b *testing.B) {
+		var mu sync.RWMutex
+		for i := 0; i < b.N; i++ {
+			mu.Lock()
+			mu.Unlock()
+		}
+	})
+
+	b.Run("smutex", func(b *testing.B) {
+		var mu SMutex128
+		for i := 0; i < b.N; i++ {
+			mu.Lock(1)
+			mu.Unlock(1)
+		}
+	})
+}
+
+func BenchmarkRLockAll(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		var mu SMutex128
+		for i := 0; i < b.N; i++ {
+			mu.RLockAll()
+			mu.RUnlockAll()
+		}
+	})
+
+	b.Run("barrier", func(b *testing.B) {
+		var mu barrierMutex
+		for i := 0; i < b.N; i++ {
+			mu.RLockAll()
+			mu.RUnlockAll()
+		}
+	})
+}
+
+func BenchmarkRLockAllContention(b *testing.B) {
+	b.Run("quiescent", func(b *testing.B) {
+		var mu SMutex128
+		for i := 0; i < b.N; i++ {
+			mu.RLockAll()
+			mu.RUnlockAll()
+		}
+	})
+
+	// Writers spread across the shards, or clustered on the first or the last ones
+	for _, bc := range []struct {
+		name    string
+		writers []uint
+	}{
+		{"writers", []uint{0, 32, 64, 96}},
+		{"low", []uint{0, 1, 2, 3}},
+		{"high", []uint{124, 125, 126, 127}},
+	} {
+		writers := bc.writers
+		b.Run(bc.name, func(b *testing.B) {
+			var mu SMutex128
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			for _, shard := range writers {
+				wg.Add(1)
+				go func(shard uint) {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							mu.Lock(shard)
+							mu.Unlock(shard)
+							runtime.Gosched()
+						}
+					}
+				}(shard)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mu.RLockAll()
+				mu.RUnlockAll()
+			}
+
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkLockParallel(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		var mu SMutex128
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			shard := uint(next.Add(1))
+			for pb.Next() {
+				mu.Lock(shard)
+				mu.Unlock(shard)
+			}
+		})
+	})
+
+	b.Run("barrier", func(b *testing.B) {
+		var mu barrierMutex
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			shard := uint(next.Add(1))
+			for pb.Next() {
+				mu.Lock(shard)
+				mu.Unlock(shard)
+			}
+		})
+	})
+}
+
+func BenchmarkLockContext(b *testing.B) {
+	var mu SMutex128
+	ctx := context.Background()
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if mu.LockContext(ctx, 1) == nil {
+				runtime.Gosched()
+				mu.Unlock(1)
+			}
+		}
+	})
+}
+
+func runBenchmark(b *testing.B, name string, store Store, size, procs int64) {
+	rand.Seed(1)
+	b.Run(fmt.Sprintf("%v/procs=%v", name, procs), func(b *testing.B) {
+		b.SetParallelism(int(procs))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for i := 0; i < 5; i++ {
+					store.Set(rand.Int63n(size), "value")
+				}
+				for i := 0; i < 5; i++ {
+					store.Get(rand.Int63n(size))
+				}
+			}
+		})
+	})
+}
+
+func TestMutex(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var resource, out string
+
+	// Acquire a write lock
+	mu.Lock(1)
+
+	// Concurrently, start a reader
+	wg.Add(1)
+	go func() {
+		mu.RLock(1)
+		defer mu.RUnlock(1)
+		out = resource
+		wg.Done()
+	}()
+
+	// Write the resource
+	resource = "hello"
+	mu.Unlock(1)
+
+	// Wait for the reader to finish
+	wg.Wait()
+	assert.Equal(t, "hello", out)
+}
+
+func TestUnlockUnderflow(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	mu.Unlock(1)
+
+	defer func() {
+		assert.Equal(t, "smutex: Unlock of unlocked mutex", recover())
+		assert.True(t, mu.TryLock(1))
+		mu.Unlock(1)
+	}()
+	mu.Unlock(1)
+}
+
+func TestRUnlockUnderflow(t *testing.T) {
+	var mu SMutex128
+	mu.RLock(1)
+	mu.RUnlock(1)
+
+	defer func() {
+		assert.Equal(t, "smutex: RUnlock of unlocked mutex", recover())
+		assert.True(t, mu.TryLock(1))
+		mu.Unlock(1)
+	}()
+	mu.RUnlock(1)
+}
+
+func TestShards(t *testing.T) {
+	var mu SMutex128
+	assert.Equal(t, uint(128), mu.Shards())
+}
+
+func TestSuggestShards(t *testing.T) {
+	tests := map[int]uint{
+		-1:   SuggestShards(runtime.GOMAXPROCS(0)),
+		1:    4,
+		2:    8,
+		3:    16,
+		5:    32,
+		16:   64,
+		32:   128,
+		1000: 128,
+	}
+
+	for parallelism, expect := range tests {
+		n := SuggestShards(parallelism)
+		assert.Equal(t, expect, n, "parallelism=%d", parallelism)
+		assert.Zero(t, n&(n-1), "parallelism=%d", parallelism)
+		assert.LessOrEqual(t, n, uint(shards))
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	var mu SMutex128
+	for key := uint(0); key < 1000; key += 7 {
+		shard := mu.ShardOf(key)
+		assert.Less(t, shard, uint(shards))
+
+		mu.Lock(key)
+		assert.False(t, mu.TryRLock(shard))
+		mu.Unlock(key)
+	}
+}
+
+func TestShardOfExtremes(t *testing.T) {
+	keys := []uint{0, 1, shards - 1, shards, shards + 1, math.MaxUint32, math.MaxUint - 1, math.MaxUint}
+	mutexes := map[string]*SMutex128{
+		"default": New(),
+		"hashed":  New(WithHash(func(k uint) uint { return k * 31 })),
+	}
+
+	for name, mu := range mutexes {
+		for _, key := range keys {
+			shard := mu.ShardOf(key)
+			assert.Less(t, shard, uint(shards), "%s: key=%d", name, key)
+			assert.NotPanics(t, func() {
+				mu.Lock(key)
+				mu.Unlock(key)
+				mu.RLock(key)
+				mu.RUnlock(key)
+			}, "%s: key=%d", name, key)
+		}
+	}
+
+	var mu SMutex128
+	assert.Equal(t, uint(shards-1), mu.ShardOf(shards-1))
+	assert.NotEqual(t, uint(0), mu.ShardOf(shards))
+}
+
+func TestShardOfStride(t *testing.T) {
+	var mu SMutex128
+	for i := uint(0); i < shards; i++ {
+		assert.Equal(t, i, mu.ShardOf(i))
+	}
+
+	// Keys spaced by the shard count, or by a divisor of it, spread across the shards
+	for _, stride := range []uint{16, shards, 4096} {
+		used := make(map[uint]bool)
+		for i := uint(0); i < 1024; i++ {
+			used[mu.ShardOf(i*stride)] = true
+		}
+		assert.Greater(t, len(used), shards/2, "stride=%d", stride)
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	var mu SMutex128
+	assert.False(t, mu.IsLocked(1))
+
+	// Only the holder can be sure of the result while the lock is held
+	mu.Lock(1)
+	assert.True(t, mu.IsLocked(1))
+	assert.False(t, mu.IsLocked(2))
+	mu.Unlock(1)
+	assert.False(t, mu.IsLocked(1))
+
+	// Readers do not count as writers
+	mu.RLock(1)
+	assert.False(t, mu.IsLocked(1))
+	mu.RUnlock(1)
+}
+
+func TestWriterCount(t *testing.T) {
+	var mu SMutex128
+	assert.Equal(t, 0, mu.WriterCount())
+
+	mu.Lock(1)
+	mu.Lock(2)
+	assert.Equal(t, 2, mu.WriterCount())
+	assert.Equal(t, 0, mu.ReaderCount())
+
+	mu.Unlock(1)
+	mu.Unlock(2)
+	assert.Equal(t, 0, mu.WriterCount())
+}
+
+func TestReaderCount(t *testing.T) {
+	var mu SMutex128
+	mu.RLock(1)
+	mu.RLock(1)
+	mu.RLock(2)
+	assert.Equal(t, 3, mu.ReaderCount())
+	assert.Equal(t, 0, mu.WriterCount())
+
+	mu.RUnlock(1)
+	mu.RUnlock(1)
+	mu.RUnlock(2)
+	assert.Equal(t, 0, mu.ReaderCount())
+}
+
+func TestTryLock(t *testing.T) {
+	var mu SMutex128
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	// Hold the write lock in a separate goroutine
+	go func() {
+		mu.Lock(1)
+		close(locked)
+		<-release
+		mu.Unlock(1)
+		close(done)
+	}()
+
+	<-locked
+	assert.False(t, mu.TryLock(1))
+
+	close(release)
+	<-done
+	assert.True(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestUnlockFromOtherGoroutine(t *testing.T) {
+	for name, mu := range map[string]*SMutex128{
+		"default": New(),
+		"options": New(WithStats(), WithDeadlockDetection(), WithFairness()),
+	} {
+		// Just like sync.RWMutex, the lock can be released by a different goroutine
+		locked := make(chan struct{})
+		go func() {
+			mu.Lock(1)
+			close(locked)
+		}()
+
+		<-locked
+		done := make(chan struct{})
+		go func() {
+			mu.Unlock(1)
+			close(done)
+		}()
+
+		<-done
+		assert.Zero(t, mu.WriterCount(), name)
+		assertCompletes(t, time.Second, func() {
+			mu.RLockAll()
+			mu.RUnlockAll()
+			mu.Lock(1)
+			mu.Unlock(1)
+		})
+	}
+}
+
+func TestTryLockLikeRWMutex(t *testing.T) {
+	type tryLocker interface {
+		Lock()
+		Unlock()
+		RLock()
+		RUnlock()
+		TryLock() bool
+		TryRLock() bool
+	}
+
+	scenarios := map[string]func(mu tryLocker) (bool, bool){
+		"free": func(mu tryLocker) (bool, bool) {
+			w := mu.TryLock()
+			mu.Unlock()
+			r := mu.TryRLock()
+			mu.RUnlock()
+			return w, r
+		},
+		"read": func(mu tryLocker) (bool, bool) {
+			mu.RLock()
+			defer mu.RUnlock()
+			r := mu.TryRLock()
+			if r {
+				mu.RUnlock()
+			}
+			return mu.TryLock(), r
+		},
+		"write": func(mu tryLocker) (bool, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			return mu.TryLock(), mu.TryRLock()
+		},
+		"pending": func(mu tryLocker) (bool, bool) {
+			mu.RLock()
+			done := make(chan struct{})
+			go func() {
+				mu.Lock()
+				mu.Unlock()
+				close(done)
+			}()
+
+			// Give the writer time to start waiting for the readers
+			time.Sleep(10 * time.Millisecond)
+			w, r := mu.TryLock(), mu.TryRLock()
+			mu.RUnlock()
+			<-done
+			return w, r
+		},
+	}
+
+	for name, scenario := range scenarios {
+		var std sync.RWMutex
+		var mu SMutex128
+		w1, r1 := scenario(&std)
+		w2, r2 := scenario(mu.AsRWMutex(1))
+		assert.Equal(t, w1, w2, "%s: TryLock", name)
+		assert.Equal(t, r1, r2, "%s: TryRLock", name)
+	}
+}
+
+func TestTryRLock(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(3)
+	assert.False(t, mu.TryRLock(3))
+	assert.True(t, mu.TryRLock(4))
+	mu.RUnlock(4)
+	mu.Unlock(3)
+
+	assert.True(t, mu.TryRLock(3))
+	mu.RUnlock(3)
+}
+
+func TestLockContext(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+
+	// Cancel the acquisition while a competing writer holds the shard
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	assert.Equal(t, context.Canceled, mu.LockContext(ctx, 1))
+	mu.Unlock(1)
+
+	// The abandoned attempt must not hold the lock
+	assert.True(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestLockContextAcquired(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		mu.Unlock(1)
+	}()
+
+	assert.NoError(t, mu.LockContext(context.Background(), 1))
+	assert.False(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestTryLockFor(t *testing.T) {
+	var mu SMutex128
+	holdFor := func(d time.Duration) {
+		mu.Lock(1)
+		go func() {
+			time.Sleep(d)
+			mu.Unlock(1)
+		}()
+	}
+
+	// Released within the timeout
+	holdFor(5 * time.Millisecond)
+	assert.True(t, mu.TryLockFor(1, 20*time.Millisecond))
+	mu.Unlock(1)
+
+	// Released after the timeout
+	holdFor(100 * time.Millisecond)
+	assert.False(t, mu.TryLockFor(1, 20*time.Millisecond))
+	assert.True(t, mu.TryLockFor(1, time.Second))
+	mu.Unlock(1)
+}
+
+func TestRLockSpin(t *testing.T) {
+	var mu SMutex128
+	assert.True(t, mu.RLockSpin(1, 0))
+	mu.RUnlock(1)
+
+	// Without spins it gives up right away, just like TryRLock
+	mu.Lock(1)
+	assert.False(t, mu.TryRLock(1))
+	assert.False(t, mu.RLockSpin(1, 0))
+
+	// With spins it waits out a writer which is released shortly after
+	go func() {
+		time.Sleep(time.Microsecond)
+		mu.Unlock(1)
+	}()
+	assert.True(t, mu.RLockSpin(1, 1e7))
+	mu.RUnlock(1)
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestJitter(t *testing.T) {
+	seed := uint64(1)
+	for delay := minDelay; delay <= maxDelay; delay *= 2 {
+		for i := 0; i < 100; i++ {
+			d := jitter(delay, &seed)
+			assert.GreaterOrEqual(t, d, delay/2)
+			assert.Less(t, d, delay)
+		}
+	}
+}
+
+func TestRLockContext(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+
+	// Hold the write lock on shard 0 for a while
+	mu.Lock(0)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		mu.Unlock(0)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, mu.RLockContext(ctx, 0))
+
+	// The abandoned attempt must not hold a read lock
+	wg.Wait()
+	assert.True(t, mu.TryLock(0))
+	mu.Unlock(0)
+
+	// Once free, the read lock is acquired right away
+	assert.NoError(t, mu.RLockContext(context.Background(), 0))
+	mu.RUnlock(0)
+}
+
+func TestLockAll(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Start concurrent per-shard writers
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i)
+					runtime.Gosched()
+					mu.Unlock(i)
+				}
+			}
+		}(uint(i))
+	}
+
+	mu.LockAll()
+	for i := uint(0); i < shards; i++ {
+		assert.False(t, mu.TryLock(i))
+		assert.False(t, mu.TryRLock(i))
+	}
+
+	close(stop)
+	mu.UnlockAll()
+	wg.Wait()
+}
+
+func TestTryLockAll(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(100)
+	assert.False(t, mu.TryLockAll())
+	assert.Equal(t, 1, mu.WriterCount())
+	mu.Unlock(100)
+
+	// A reader is in the way just as much as a writer
+	mu.RLock(0)
+	assert.False(t, mu.TryLockAll())
+	assert.Zero(t, mu.WriterCount())
+	mu.RUnlock(0)
+
+	assert.True(t, mu.TryLockAll())
+	assert.Equal(t, shards, mu.WriterCount())
+	mu.UnlockAll()
+	assert.Zero(t, mu.WriterCount())
+}
+
+func TestUnlockAll(t *testing.T) {
+	var mu SMutex128
+	mu.LockAll()
+	mu.UnlockAll()
+
+	// Per-shard writers can use the mutex again
+	for i := uint(0); i < shards; i++ {
+		assert.True(t, mu.TryLock(i))
+		mu.Unlock(i)
+	}
+}
+
+func TestUnlockAllPanics(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(5)
+	defer mu.Unlock(5)
+
+	assert.PanicsWithValue(t, "smutex: UnlockAll of unlocked mutex", func() {
+		mu.UnlockAll()
+	})
+}
+
+func TestRLockAll(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var data [shards]int
+	stop := make(chan struct{})
+
+	// Start a lot of writers hammering the shards
+	for i := 0; i < 512; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i)
+					data[mu.ShardOf(i)]++
+					mu.Unlock(i)
+				}
+			}
+		}(uint(i))
+	}
+
+	// No writer is allowed to modify the data while all shards are read-locked
+	mu.RLockAll()
+	before := data
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, before, data)
+	mu.RUnlockAll()
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestRLockAllNested(t *testing.T) {
+	var mu SMutex128
+	mu.RLockAll()
+
+	// A nested read of a shard is balanced on its own and keeps the outer hold
+	mu.RLock(5)
+	assert.Equal(t, shards+1, mu.ReaderCount())
+	mu.RUnlock(5)
+	assert.Equal(t, shards, mu.ReaderCount())
+	assert.False(t, mu.TryLock(5))
+
+	// With a writer waiting for the shard, TryRLock fails instead of deadlocking
+	done := make(chan struct{})
+	go func() {
+		mu.Lock(5)
+		mu.Unlock(5)
+		close(done)
+	}()
+
+	for mu.TryRLock(5) {
+		mu.RUnlock(5)
+		runtime.Gosched()
+	}
+
+	mu.RUnlockAll()
+	<-done
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRLockAllConcurrentReaders(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	mu.RLockAll()
+
+	// Readers on other goroutines are not blocked by the scan
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(shard uint) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				mu.RLock(shard)
+				mu.RUnlock(shard)
+			}
+		}(uint(i * 16))
+	}
+
+	assertCompletes(t, time.Second, wg.Wait)
+	assert.Equal(t, shards, mu.ReaderCount())
+	assert.False(t, mu.TryLock(16))
+	mu.RUnlockAll()
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRLockAllExcludesWriters(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var scanning, violations atomic.Int32
+	stop := make(chan struct{})
+
+	// Writers record if they ever hold a shard during a scan. They yield while holding
+	// the lock so that the scans are not delayed by scheduler time slices.
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i)
+					if scanning.Load() != 0 {
+						violations.Add(1)
+					}
+					runtime.Gosched()
+					mu.Unlock(i)
+				}
+			}
+		}(uint(i))
+	}
+
+	assertCompletes(t, 10*time.Second, func() {
+		for i := 0; i < 10; i++ {
+			mu.RLockAll()
+			scanning.Store(1)
+			runtime.Gosched()
+			scanning.Store(0)
+			mu.RUnlockAll()
+		}
+	})
+
+	close(stop)
+	wg.Wait()
+	assert.Zero(t, violations.Load())
+}
+
+func TestRLockAllConcurrent(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var scanning, violations atomic.Int32
+	stop := make(chan struct{})
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i * 2)
+					if scanning.Load() != 0 {
+						violations.Add(1)
+					}
+					runtime.Gosched()
+					mu.Unlock(i * 2)
+				}
+			}
+		}(uint(i))
+	}
+
+	// Several scans overlap with each other, and none of them lets a writer in
+	assertCompletes(t, 10*time.Second, func() {
+		var scans sync.WaitGroup
+		for s := 0; s < 4; s++ {
+			scans.Add(1)
+			go func() {
+				defer scans.Done()
+				for i := 0; i < 10; i++ {
+					mu.RLockAll()
+					scanning.Add(1)
+					runtime.Gosched()
+					scanning.Add(-1)
+					mu.RUnlockAll()
+				}
+			}()
+		}
+		scans.Wait()
+	})
+
+	close(stop)
+	wg.Wait()
+	assert.Zero(t, violations.Load())
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRLockAllSingleProc(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var data [shards]int
+	stop := make(chan struct{})
+
+	// Writers never yield, so they only make way for the scans when preempted
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i * 8)
+					data[i*8]++
+					mu.Unlock(i * 8)
+				}
+			}
+		}(uint(i))
 	}
 
-	sharded := newSharded()
-	for i := int64(64); i <= (1 << 16); i *= 4 {
-		runBenchmark(b, "sharded", sharded, size, i)
+	assertCompletes(t, 20*time.Second, func() {
+		for i := 0; i < 3; i++ {
+			mu.RLockAll()
+			mu.RUnlockAll()
+		}
+	})
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestRLockAllFairness(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Keep the shards under sustained writer load. The writers yield while holding the
+	// lock so that this measures lock-level fairness, not scheduler time slices.
+	for i := 0; i < 512; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					mu.Lock(i)
+					runtime.Gosched()
+					mu.Unlock(i)
+				}
+			}
+		}(uint(i))
+	}
+
+	for i := 0; i < 10; i++ {
+		assertCompletes(t, time.Second, func() {
+			mu.RLockAll()
+			mu.RUnlockAll()
+		})
 	}
+
+	close(stop)
+	wg.Wait()
 }
 
-func BenchmarkLockUnlock(b *testing.B) {
-	b.Run("rwmutex", func(b *testing.B) {
-		var mu sync.RWMutex
-		for i := 0; i < b.N; i++ {
-			mu.Lock()
-			mu.Unlock()
-		}
+func TestRLockAllContext(t *testing.T) {
+	var mu SMutex128
+	assert.NoError(t, mu.RLockAllContext(context.Background()))
+	assert.Equal(t, shards, mu.ReaderCount())
+	assert.False(t, mu.TryLock(5))
+	mu.RUnlockAll()
+
+	// A writer stuck on a shard makes the scan give up and roll back
+	mu.Lock(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, mu.RLockAllContext(ctx))
+	assert.Zero(t, mu.ReaderCount())
+	mu.Unlock(100)
+	assert.True(t, mu.TryLock(5))
+	mu.Unlock(5)
+}
+
+func TestRLockAllContextReentrant(t *testing.T) {
+	mu := New(WithReentrantRLockAll())
+	mu.Lock(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Error(t, mu.RLockAllContext(ctx))
+	mu.Unlock(100)
+
+	// The failed attempt didn't count as an outer scan
+	assert.NoError(t, mu.RLockAllContext(context.Background()))
+	assert.NoError(t, mu.RLockAllContext(context.Background()))
+	mu.RUnlockAll()
+	mu.RUnlockAll()
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRUnlockAll(t *testing.T) {
+	var mu SMutex128
+	mu.RLockAll()
+	for i := uint(0); i < shards; i++ {
+		assert.False(t, mu.TryLock(i))
+	}
+
+	mu.RUnlockAll()
+	for i := uint(0); i < shards; i++ {
+		assert.True(t, mu.TryLock(i))
+		mu.Unlock(i)
+	}
+}
+
+func TestIsRLockAllActive(t *testing.T) {
+	mu := New(WithReentrantRLockAll())
+	assert.False(t, mu.IsRLockAllActive())
+
+	// Ordinary readers do not count as a scan
+	mu.RLock(1)
+	assert.False(t, mu.IsRLockAllActive())
+	mu.RUnlock(1)
+
+	mu.RLockAll()
+	assert.True(t, mu.IsRLockAllActive())
+	mu.RLockAll()
+	mu.RUnlockAll()
+	assert.True(t, mu.IsRLockAllActive())
+	mu.RUnlockAll()
+	assert.False(t, mu.IsRLockAllActive())
+
+	// A scan which gave up is not active
+	mu.Lock(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Error(t, mu.RLockAllContext(ctx))
+	assert.False(t, mu.IsRLockAllActive())
+	mu.Unlock(100)
+}
+
+func TestRLockAllFunc(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var written bool
+
+	func() {
+		defer mu.RLockAllFunc()()
+
+		// Start a writer which should only proceed once the scope exits
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock(7)
+			written = true
+			mu.Unlock(7)
+		}()
+
+		time.Sleep(5 * time.Millisecond)
+		assert.False(t, mu.TryLock(7))
+	}()
+
+	wg.Wait()
+	assert.True(t, written)
+}
+
+func TestRLockAllFuncOnce(t *testing.T) {
+	var mu SMutex128
+	release := mu.RLockAllFunc()
+	release()
+	release()
+
+	assert.True(t, mu.TryLock(0))
+	mu.Unlock(0)
+}
+
+func TestRange(t *testing.T) {
+	var mu SMutex128
+	calls := make([]int, shards)
+	mu.Range(func(shard uint) {
+		calls[shard]++
+
+		// Only the visited shard is locked
+		assert.False(t, mu.TryLock(shard))
+		assert.True(t, mu.TryLock(shard+1))
+		mu.Unlock(shard + 1)
 	})
 
-	b.Run("smutex", func(b *testing.B) {
-		var mu sync.RWMutex
-		for i := 0; i < b.N; i++ {
-			mu.Lock()
-			mu.Unlock()
+	for i := range calls {
+		assert.Equal(t, 1, calls[i])
+	}
+	assert.Zero(t, mu.ReaderCount())
+}
+
+func TestRangeConcurrentWriter(t *testing.T) {
+	var mu SMutex128
+	done := make(chan struct{})
+	// A writer of a shard which was not visited yet proceeds while the scan is paused
+	mu.Range(func(shard uint) {
+		if shard == 0 {
+			go func() {
+				mu.Lock(100)
+				mu.Unlock(100)
+				close(done)
+			}()
+			<-done
 		}
 	})
 }
 
-func runBenchmark(b *testing.B, name string, store Store, size, procs int64) {
-	rand.Seed(1)
-	b.Run(fmt.Sprintf("%v/procs=%v", name, procs), func(b *testing.B) {
-		b.SetParallelism(int(procs))
-		b.RunParallel(func(pb *testing.PB) {
-			for pb.Next() {
-				for i := 0; i < 5; i++ {
-					store.Set(rand.Int63n(size), "value")
-				}
-				for i := 0; i < 5; i++ {
-					store.Get(rand.Int63n(size))
+func TestForEachWrite(t *testing.T) {
+	var mu SMutex128
+	calls := make([]int, shards)
+	mu.ForEachWrite(func(shard uint) {
+		calls[shard]++
+
+		// Only the visited shard is locked
+		assert.Equal(t, 1, mu.WriterCount())
+		assert.False(t, mu.TryRLock(shard))
+	})
+
+	for i := range calls {
+		assert.Equal(t, 1, calls[i])
+	}
+	assert.Zero(t, mu.WriterCount())
+
+	// A panic releases the shard and stops the iteration
+	visited := 0
+	assert.PanicsWithValue(t, "boom", func() {
+		mu.ForEachWrite(func(shard uint) {
+			visited++
+			if shard == 5 {
+				panic("boom")
+			}
+		})
+	})
+	assert.Equal(t, 6, visited)
+	assert.Zero(t, mu.WriterCount())
+	assert.True(t, mu.TryLock(5))
+	mu.Unlock(5)
+}
+
+func TestWithLock(t *testing.T) {
+	var mu SMutex128
+	var called bool
+	mu.WithLock(2, func() {
+		called = true
+		assert.False(t, mu.TryRLock(2))
+	})
+
+	assert.True(t, called)
+	assert.Panics(t, func() {
+		mu.WithLock(2, func() { panic("boom") })
+	})
+
+	assert.True(t, mu.TryLock(2))
+	mu.Unlock(2)
+}
+
+func TestWithRLock(t *testing.T) {
+	var mu SMutex128
+	var called bool
+	mu.WithRLock(2, func() {
+		called = true
+		assert.False(t, mu.TryLock(2))
+	})
+
+	assert.True(t, called)
+	assert.Panics(t, func() {
+		mu.WithRLock(2, func() { panic("boom") })
+	})
+
+	assert.True(t, mu.TryLock(2))
+	mu.Unlock(2)
+}
+
+func TestWaitForWriters(t *testing.T) {
+	var mu SMutex128
+	mu.WaitForWriters()
+
+	mu.Lock(1)
+	mu.Lock(100)
+	mu.RLock(2)
+	released := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mu.Unlock(100)
+		released <- time.Now()
+		mu.Unlock(1)
+	}()
+
+	// Readers do not hold it up, and it takes no lock itself
+	assertCompletes(t, time.Second, mu.WaitForWriters)
+	assert.WithinDuration(t, <-released, time.Now(), 100*time.Millisecond)
+	assert.Zero(t, mu.WriterCount())
+	assert.Equal(t, 1, mu.ReaderCount())
+	mu.RUnlock(2)
+}
+
+func TestWithSnapshot(t *testing.T) {
+	var mu SMutex128
+	var data [shards]int
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Writers move a unit from one shard to another, so the total never changes
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
 				}
+
+				from, to := uint(rnd.Intn(shards)), uint(rnd.Intn(shards))
+				mu.LockMany(from, to)
+				data[from]--
+				runtime.Gosched()
+				data[to]++
+				mu.UnlockMany(from, to)
+			}
+		}(int64(w))
+	}
+
+	for i := 0; i < 20; i++ {
+		mu.WithSnapshot(func() {
+			total := 0
+			for _, v := range data {
+				total += v
 			}
+			assert.Zero(t, total)
 		})
+	}
+
+	close(stop)
+	wg.Wait()
+	assert.Panics(t, func() {
+		mu.WithSnapshot(func() { panic("boom") })
 	})
+	assert.Zero(t, mu.ReaderCount())
 }
 
-func TestMutex(t *testing.T) {
+func TestUpgrade(t *testing.T) {
+	var mu SMutex128
+	var data [shards]int
+
+	// Read the value, decide to change it and upgrade without a gap
+	mu.RLock(1)
+	value := data[1]
+	assert.True(t, mu.Upgrade(1))
+	assert.False(t, mu.TryRLock(1))
+	data[1] = value + 1
+	mu.Unlock(1)
+
+	assert.Equal(t, 1, data[1])
+	assert.True(t, mu.TryLock(1))
+	mu.Unlock(1)
+}
+
+func TestUpgradeConcurrent(t *testing.T) {
+	var mu SMutex128
+	var wg, ready sync.WaitGroup
+	var counter int
+	results := make(chan bool, 2)
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.RLock(1)
+			seen := counter
+			ready.Done()
+			ready.Wait()
+
+			// The loser must re-read what it has seen before writing
+			ok := mu.Upgrade(1)
+			if !ok {
+				seen = counter
+			}
+
+			counter = seen + 1
+			mu.Unlock(1)
+			results <- ok
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+	upgraded := 0
+	for ok := range results {
+		if ok {
+			upgraded++
+		}
+	}
+
+	assert.Equal(t, 1, upgraded)
+	assert.Equal(t, 2, counter)
+}
+
+func TestUpgradeWithWriters(t *testing.T) {
 	var mu SMutex128
 	var wg sync.WaitGroup
-	var resource, out string
+	var data int
+
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				mu.Lock(1)
+				data++
+				mu.Unlock(1)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				mu.RLock(1)
+				seen := data
+				if !mu.Upgrade(1) {
+					seen = data
+				}
+
+				data = seen + 1
+				mu.Unlock(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1600, data)
+}
+
+func TestUnlockWakesParkedWriter(t *testing.T) {
+	var mu SMutex128
+	mu.RLock(1)
+	mu.RLock(1)
+
+	// The upgrade pins the shard while it waits for the other reader to leave
+	upgraded := make(chan struct{})
+	go func() {
+		mu.Upgrade(1)
+		close(upgraded)
+	}()
+	for mu.mu[1].pinned.Load() == nil {
+		runtime.Gosched()
+	}
+
+	// This writer parks on the pin instead of the lock itself
+	written := make(chan struct{})
+	go func() {
+		mu.Lock(1)
+		mu.Unlock(1)
+		close(written)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	mu.RUnlock(1)
+	<-upgraded
+	mu.Unlock(1)
+	assertCompletes(t, time.Second, func() { <-written })
+}
+
+func TestRUnlockAllWakesWriter(t *testing.T) {
+	var mu SMutex128
+	mu.RLockAll()
+	written := make(chan struct{})
+	go func() {
+		mu.Lock(5)
+		mu.Unlock(5)
+		close(written)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	mu.RUnlockAll()
+	assertCompletes(t, time.Second, func() { <-written })
+}
+
+func TestUpgradeUnlocked(t *testing.T) {
+	var mu SMutex128
+	assert.PanicsWithValue(t, "smutex: Upgrade of unlocked mutex", func() {
+		mu.Upgrade(1)
+	})
+
+	// The shard must remain usable after the recovered panic
+	assert.True(t, mu.TryLockFor(1, 200*time.Millisecond))
+	mu.Unlock(1)
+}
+
+func TestTryUpgrade(t *testing.T) {
+	var mu SMutex128
+	mu.RLock(1)
+	assert.True(t, mu.TryUpgrade(1))
+	assert.True(t, mu.IsLocked(1))
+	assert.False(t, mu.TryRLock(1))
+	mu.Unlock(1)
+
+	// With another reader present, the read lock is kept
+	mu.RLock(1)
+	mu.RLock(1)
+	assert.False(t, mu.TryUpgrade(1))
+	assert.Equal(t, 2, mu.ReaderCount())
+	mu.RUnlock(1)
+	assert.True(t, mu.TryUpgrade(1))
+	mu.Unlock(1)
+}
+
+func TestTryUpgradeConcurrent(t *testing.T) {
+	var mu SMutex128
+	var wg, held sync.WaitGroup
+	var upgraded atomic.Int32
+
+	held.Add(2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.RLock(1)
+			held.Done()
+			held.Wait()
+
+			if mu.TryUpgrade(1) {
+				upgraded.Add(1)
+				mu.Unlock(1)
+				return
+			}
+			mu.RUnlock(1)
+		}()
+	}
+
+	assertCompletes(t, time.Second, wg.Wait)
+	assert.LessOrEqual(t, upgraded.Load(), int32(1))
+	assert.Zero(t, mu.ReaderCount())
+	assert.Zero(t, mu.WriterCount())
+}
+
+func TestTryUpgradeUnlocked(t *testing.T) {
+	var mu SMutex128
+	assert.PanicsWithValue(t, "smutex: TryUpgrade of unlocked mutex", func() {
+		mu.TryUpgrade(1)
+	})
+
+	// The shard must remain usable after the recovered panic
+	assert.True(t, mu.TryLockFor(1, 200*time.Millisecond))
+	mu.Unlock(1)
+}
+
+func TestDowngrade(t *testing.T) {
+	var mu SMutex128
+	var wg sync.WaitGroup
+	var data, seen string
 
-	// Acquire a write lock
 	mu.Lock(1)
+	data = "hello"
 
-	// Concurrently, start a reader
-	wg.Add(1)
+	// Queue a reader, then a writer behind the write lock
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		mu.RLock(1)
-		defer mu.RUnlock(1)
-		out = resource
-		wg.Done()
+		seen = data
+		mu.RUnlock(1)
 	}()
+	time.Sleep(5 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		mu.Lock(1)
+		data = "world"
+		mu.Unlock(1)
+	}()
+	time.Sleep(5 * time.Millisecond)
 
-	// Write the resource
-	resource = "hello"
-	mu.Unlock(1)
+	// Both the downgrading goroutine and the reader observe the same value
+	mu.Downgrade(1)
+	assert.Equal(t, "hello", data)
+	assert.False(t, mu.TryLock(1))
+	mu.RUnlock(1)
 
-	// Wait for the reader to finish
 	wg.Wait()
-	assert.Equal(t, "hello", out)
+	assert.Equal(t, "hello", seen)
+	assert.Equal(t, "world", data)
+}
+
+func TestDowngradeUnlocked(t *testing.T) {
+	var mu SMutex128
+	assert.PanicsWithValue(t, "smutex: Downgrade of unlocked mutex", func() {
+		mu.Downgrade(1)
+	})
+
+	// The shard must remain usable after the recovered panic
+	assert.True(t, mu.TryLockFor(1, 200*time.Millisecond))
+	mu.Unlock(1)
+}
+
+// --------------------------- Barrier Mutex ----------------------------
+
+// barrierMutex is an alternative design where RLockAll takes a single global read lock
+// and every writer takes that same lock for reading on top of its shard lock. It is only
+// used to compare against the per-shard RLockAll in the benchmarks.
+type barrierMutex struct {
+	all sync.RWMutex
+	mu  SMutex128
+}
+
+func (rw *barrierMutex) Lock(shard uint) {
+	rw.all.RLock()
+	rw.mu.Lock(shard)
+}
+
+func (rw *barrierMutex) Unlock(shard uint) {
+	rw.mu.Unlock(shard)
+	rw.all.RUnlock()
+}
+
+func (rw *barrierMutex) RLockAll() {
+	rw.all.Lock()
+}
+
+func (rw *barrierMutex) RUnlockAll() {
+	rw.all.Unlock()
 }
 
 // --------------------------- Locked Map ----------------------------
@@ -153,27 +1556,63 @@ func newSharded() *shardedMap {
 
 // Set sets the value into a locked map
 func (l *shardedMap) Set(k int64, v string) {
+	shard := l.data[l.mu.ShardOf(uint(k))]
 	l.mu.Lock(uint(k))
 	for i := 0; i < work; i++ {
-		l.data[k%shards][k] = v
+		shard[k] = v
 	}
 	runtime.Gosched()
 	for i := 0; i < work; i++ {
-		l.data[k%shards][k] = v
+		shard[k] = v
 	}
 	l.mu.Unlock(uint(k))
 }
 
 // Get gets a value from a locked map
 func (l *shardedMap) Get(k int64) (v string) {
+	shard := l.data[l.mu.ShardOf(uint(k))]
 	l.mu.RLock(uint(k))
 	for i := 0; i < work; i++ {
-		v, _ = l.data[k%shards][k]
+		v, _ = shard[k]
 	}
 	runtime.Gosched()
 	for i := 0; i < work; i++ {
-		v, _ = l.data[k%shards][k]
+		v, _ = shard[k]
 	}
 	l.mu.RUnlock(uint(k))
 	return
 }
+
+// --------------------------- Sync Map ----------------------------
+
+// An implementation of the store using a sync.Map, doing the same amount of work
+type syncMap struct {
+	data sync.Map
+}
+
+// Set sets the value into the map
+func (l *syncMap) Set(k int64, v string) {
+	for i := 0; i < work; i++ {
+		l.data.Store(k, v)
+	}
+	runtime.Gosched()
+	for i := 0; i < work; i++ {
+		l.data.Store(k, v)
+	}
+}
+
+// Get gets a value from the map
+func (l *syncMap) Get(k int64) (v string) {
+	for i := 0; i < work; i++ {
+		if x, ok := l.data.Load(k); ok {
+			v = x.(string)
+		}
+	}
+	runtime.Gosched()
+	for i := 0; i < work; i++ {
+		if x, ok := l.data.Load(k); ok {
+			v = x.(string)
+		}
+	}
+	return
+}
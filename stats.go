@@ -0,0 +1,140 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// ShardStat represents the number of lock acquisitions of a single shard. FastAcquires
+// and SlowAcquires only count the Lock and RLock calls, depending on whether the shard
+// was acquired right away or they had to wait, while Writes and Reads count every kind
+// of acquisition, including the Try and Context variants.
+type ShardStat struct {
+	Writes       uint64        // Number of write lock acquisitions
+	Reads        uint64        // Number of read lock acquisitions
+	Wait         time.Duration // Time spent blocked waiting, if enabled with WithWaitTime()
+	FastAcquires uint64        // Number of Lock and RLock calls which did not wait
+	SlowAcquires uint64        // Number of Lock and RLock calls which had to wait
+}
+
+// Stats returns the acquisition counters for every shard, or nil if the mutex was not
+// created with the WithStats() option.
+func (rw *SMutex128) Stats() []ShardStat {
+	if rw.cfg == nil || rw.cfg.stats == nil {
+		return nil
+	}
+
+	out := make([]ShardStat, shards)
+	for i := range rw.cfg.stats {
+		out[i] = ShardStat{
+			Writes:       rw.cfg.stats[i].writes.Load(),
+			Reads:        rw.cfg.stats[i].reads.Load(),
+			Wait:         time.Duration(rw.cfg.stats[i].wait.Load()),
+			FastAcquires: rw.cfg.stats[i].fast.Load(),
+			SlowAcquires: rw.cfg.stats[i].slow.Load(),
+		}
+	}
+	return out
+}
+
+// SnapshotStats returns the acquisition counters for every shard, just like Stats, and
+// resets them to zero at the same time, so that the next snapshot only reports what
+// happened since this one. Every counter is swapped atomically, so no acquisition is
+// lost or counted twice even if the shards are locked meanwhile, but the counters of a
+// shard are swapped one after another and do not form a consistent snapshot. It returns
+// nil if the mutex was not created with the WithStats() option.
+func (rw *SMutex128) SnapshotStats() []ShardStat {
+	if rw.cfg == nil || rw.cfg.stats == nil {
+		return nil
+	}
+
+	out := make([]ShardStat, shards)
+	for i := range rw.cfg.stats {
+		out[i] = ShardStat{
+			Writes:       rw.cfg.stats[i].writes.Swap(0),
+			Reads:        rw.cfg.stats[i].reads.Swap(0),
+			Wait:         time.Duration(rw.cfg.stats[i].wait.Swap(0)),
+			FastAcquires: rw.cfg.stats[i].fast.Swap(0),
+			SlowAcquires: rw.cfg.stats[i].slow.Swap(0),
+		}
+	}
+	return out
+}
+
+// Reset zeroes the statistics of every shard, so that the mutex can be reused as if it
+// was freshly created. It must be called while holding all of the shards for writing,
+// after LockAll, and panics otherwise.
+func (rw *SMutex128) Reset() {
+	if rw.named() {
+		defer rw.cfg.rename()
+	}
+
+	for i := range rw.mu {
+		if rw.mu[i].writer.Load() == 0 {
+			panic("smutex: Reset of unlocked mutex")
+		}
+	}
+
+	if rw.cfg == nil || rw.cfg.stats == nil {
+		return
+	}
+
+	for i := range rw.cfg.stats {
+		rw.cfg.stats[i].writes.Store(0)
+		rw.cfg.stats[i].reads.Store(0)
+		rw.cfg.stats[i].wait.Store(0)
+		rw.cfg.stats[i].fast.Store(0)
+		rw.cfg.stats[i].slow.Store(0)
+	}
+}
+
+// PublishExpvar publishes the per-shard statistics under the given name, so they can be
+// inspected as JSON at /debug/vars. Each shard reports its acquisition counters along
+// with whether it currently has a writer and how many readers it has. This is a no-op
+// if the mutex was not created with the WithStats() option. Just like expvar.Publish,
+// it panics if the name is already registered.
+func (rw *SMutex128) PublishExpvar(name string) {
+	if rw.cfg == nil || rw.cfg.stats == nil {
+		return
+	}
+
+	expvar.Publish(name, expvar.Func(func() any {
+		return rw.expvar()
+	}))
+}
+
+// shardVar represents the published state of a single shard
+type shardVar struct {
+	Writes  uint64 `json:"writes"`
+	Reads   uint64 `json:"reads"`
+	Writer  bool   `json:"writer"`
+	Readers int32  `json:"readers"`
+}
+
+// expvar collects the published state of every shard
+func (rw *SMutex128) expvar() []shardVar {
+	out := make([]shardVar, 0, shards)
+	for i, stat := range rw.Stats() {
+		out = append(out, shardVar{
+			Writes:  stat.Writes,
+			Reads:   stat.Reads,
+			Writer:  rw.mu[i].writer.Load() == 1,
+			Readers: rw.mu[i].readers.Load(),
+		})
+	}
+	return out
+}
+
+// counters represents the atomic counters of a shard
+type counters struct {
+	writes atomic.Uint64
+	reads  atomic.Uint64
+	wait   atomic.Int64
+	fast   atomic.Uint64
+	slow   atomic.Uint64
+	_      [24]byte // Padding to prevent false sharing
+}
@@ -0,0 +1,186 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	mu := New(WithStats())
+	for i := 0; i < 10; i++ {
+		mu.Lock(1)
+		mu.Unlock(1)
+	}
+
+	for i := 0; i < 5; i++ {
+		mu.RLock(2)
+		mu.RUnlock(2)
+	}
+
+	assert.True(t, mu.TryLock(3))
+	mu.Unlock(3)
+	mu.LockAll()
+	mu.UnlockAll()
+
+	stats := mu.Stats()
+	assert.Len(t, stats, shards)
+	assert.Equal(t, ShardStat{Writes: 11, FastAcquires: 11}, stats[1])
+	assert.Equal(t, ShardStat{Writes: 1, Reads: 5, FastAcquires: 6}, stats[2])
+	assert.Equal(t, ShardStat{Writes: 2, FastAcquires: 1}, stats[3])
+	assert.Equal(t, ShardStat{Writes: 1, FastAcquires: 1}, stats[4])
+}
+
+func TestStatsDisabled(t *testing.T) {
+	var mu SMutex128
+	mu.Lock(1)
+	mu.Unlock(1)
+	assert.Nil(t, mu.Stats())
+	assert.Nil(t, New().Stats())
+}
+
+func TestSnapshotStats(t *testing.T) {
+	mu := New(WithStats())
+	for i := 0; i < 3; i++ {
+		mu.Lock(1)
+		mu.Unlock(1)
+	}
+	mu.RLock(2)
+	mu.RUnlock(2)
+
+	stats := mu.SnapshotStats()
+	assert.Len(t, stats, shards)
+	assert.Equal(t, ShardStat{Writes: 3, FastAcquires: 3}, stats[1])
+	assert.Equal(t, ShardStat{Reads: 1, FastAcquires: 1}, stats[2])
+	assert.Equal(t, make([]ShardStat, shards), mu.Stats())
+
+	// Only the activity since the last snapshot is reported
+	mu.Lock(1)
+	mu.Unlock(1)
+	stats = mu.SnapshotStats()
+	assert.Equal(t, ShardStat{Writes: 1, FastAcquires: 1}, stats[1])
+	assert.Equal(t, ShardStat{}, stats[2])
+	assert.Nil(t, New().SnapshotStats())
+}
+
+func TestStatsSlowAcquires(t *testing.T) {
+	contended := make(chan uint, 2)
+	mu := New(WithStats(), WithContentionHook(func(shard uint) {
+		contended <- shard
+	}))
+
+	mu.Lock(2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mu.Lock(2)
+		mu.Unlock(2)
+	}()
+	go func() {
+		defer wg.Done()
+		mu.RLock(2)
+		mu.RUnlock(2)
+	}()
+
+	<-contended
+	<-contended
+	mu.Unlock(2)
+	wg.Wait()
+
+	// Uncontended calls take the fast path, and the Try variants are not counted
+	mu.RLock(3)
+	mu.RUnlock(3)
+	assert.True(t, mu.TryLock(3))
+	mu.Unlock(3)
+
+	stats := mu.Stats()
+	assert.Equal(t, ShardStat{Writes: 2, Reads: 1, FastAcquires: 1, SlowAcquires: 2}, stats[2])
+	assert.Equal(t, ShardStat{Writes: 1, Reads: 1, FastAcquires: 1}, stats[3])
+}
+
+func TestReset(t *testing.T) {
+	mu := New(WithStats())
+	mu.Lock(1)
+	mu.Unlock(1)
+	mu.RLock(2)
+	mu.RUnlock(2)
+
+	mu.LockAll()
+	mu.Reset()
+	mu.UnlockAll()
+	assert.Equal(t, make([]ShardStat, shards), mu.Stats())
+
+	// The mutex keeps working after the reset
+	mu.Lock(1)
+	mu.Unlock(1)
+	assert.Equal(t, uint64(1), mu.Stats()[1].Writes)
+}
+
+func TestResetUnlocked(t *testing.T) {
+	mu := New(WithStats())
+	assert.PanicsWithValue(t, "smutex: Reset of unlocked mutex", mu.Reset)
+
+	mu.Lock(1)
+	defer mu.Unlock(1)
+	assert.PanicsWithValue(t, "smutex: Reset of unlocked mutex", mu.Reset)
+}
+
+func TestWaitTime(t *testing.T) {
+	mu := New(WithWaitTime())
+	done := make(chan struct{})
+
+	// Hold the shard so that the other goroutine has to wait for it
+	mu.Lock(1)
+	go func() {
+		mu.Lock(1)
+		mu.Unlock(1)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Unlock(1)
+	<-done
+
+	stats := mu.Stats()
+	assert.Equal(t, uint64(2), stats[1].Writes)
+	assert.GreaterOrEqual(t, stats[1].Wait, 5*time.Millisecond)
+	assert.Zero(t, stats[2].Wait)
+}
+
+func TestPublishExpvar(t *testing.T) {
+	// Vars can't be unpublished, so use a fresh name every time the test runs
+	name := fmt.Sprintf("smutex_test_%d", time.Now().UnixNano())
+	mu := New(WithStats())
+	mu.PublishExpvar(name)
+	for i := 0; i < 3; i++ {
+		mu.Lock(1)
+		mu.Unlock(1)
+	}
+
+	mu.RLock(2)
+	defer mu.RUnlock(2)
+	mu.Lock(3)
+	defer mu.Unlock(3)
+
+	var out []shardVar
+	assert.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &out))
+	assert.Len(t, out, shards)
+	assert.Equal(t, shardVar{Writes: 3}, out[1])
+	assert.Equal(t, shardVar{Reads: 1, Readers: 1}, out[2])
+	assert.Equal(t, shardVar{Writes: 1, Writer: true}, out[3])
+}
+
+func TestPublishExpvarDisabled(t *testing.T) {
+	var mu SMutex128
+	mu.PublishExpvar("smutex_disabled")
+	assert.Nil(t, expvar.Get("smutex_disabled"))
+}
@@ -0,0 +1,24 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"context"
+	"runtime/trace"
+	"strconv"
+)
+
+// traceRegion starts a region of the execution tracer for a wait on the shard at index i
+// of the named mutex, which must be ended once the lock is acquired.
+func traceRegion(name, mutex string, i uint) *trace.Region {
+	ctx := context.Background()
+	region := trace.StartRegion(ctx, name)
+	if trace.IsEnabled() {
+		trace.Log(ctx, "shard", strconv.Itoa(int(i)))
+		if mutex != "" {
+			trace.Log(ctx, "mutex", mutex)
+		}
+	}
+	return region
+}
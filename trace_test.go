@@ -0,0 +1,48 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"bytes"
+	"runtime/trace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTracing(t *testing.T) {
+	var buffer bytes.Buffer
+	assert.NoError(t, trace.Start(&buffer))
+
+	// Make both a writer and a reader wait for the shard
+	mu := New(WithTracing())
+	mu.Lock(1)
+	done := make(chan struct{})
+	go func() {
+		mu.Lock(1)
+		mu.Unlock(1)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Unlock(1)
+	<-done
+
+	mu.Lock(1)
+	done = make(chan struct{})
+	go func() {
+		mu.RLock(1)
+		mu.RUnlock(1)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Unlock(1)
+	<-done
+	trace.Stop()
+
+	assert.True(t, bytes.Contains(buffer.Bytes(), []byte("smutex.Lock")))
+	assert.True(t, bytes.Contains(buffer.Bytes(), []byte("smutex.RLock")))
+}
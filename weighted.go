@@ -0,0 +1,52 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+// Weighted represents a sharded counting semaphore, where every shard can be held by up
+// to a fixed number of writers at once instead of a single one. This suits critical
+// sections which tolerate a bounded amount of concurrency, such as appending to
+// independent sub-buckets. The keys are mapped to the shards just like in SMutex128.
+type Weighted struct {
+	sem [shards]chan struct{}
+}
+
+// NewWeighted creates a new sharded semaphore where every shard can be held by up to
+// perShard writers simultaneously. It panics if perShard is zero.
+func NewWeighted(perShard uint) *Weighted {
+	if perShard == 0 {
+		panic("smutex: NewWeighted with zero capacity")
+	}
+
+	w := new(Weighted)
+	for i := range w.sem {
+		w.sem[i] = make(chan struct{}, perShard)
+	}
+	return w
+}
+
+// Lock acquires a unit of the shard, blocking until one is available.
+func (w *Weighted) Lock(shard uint) {
+	w.sem[shardOf(shard)] <- struct{}{}
+}
+
+// TryLock tries to acquire a unit of the shard without blocking and reports whether it
+// succeeded.
+func (w *Weighted) TryLock(shard uint) bool {
+	select {
+	case w.sem[shardOf(shard)] <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unlock releases a unit of the shard acquired with Lock or TryLock. It panics if no
+// unit of the shard is held.
+func (w *Weighted) Unlock(shard uint) {
+	select {
+	case <-w.sem[shardOf(shard)]:
+	default:
+		panic("smutex: Unlock of unlocked mutex")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Roman Atachiants and contributors. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+
+package smutex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeighted(t *testing.T) {
+	w := NewWeighted(3)
+	for i := 0; i < 3; i++ {
+		w.Lock(1)
+	}
+	assert.False(t, w.TryLock(1))
+
+	// Other shards are not affected
+	assert.True(t, w.TryLock(2))
+	w.Unlock(2)
+
+	// The next writer blocks until a unit is released
+	locked := make(chan struct{})
+	go func() {
+		w.Lock(1)
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Lock returned while the shard was at capacity")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	w.Unlock(1)
+	assertCompletes(t, time.Second, func() { <-locked })
+	for i := 0; i < 3; i++ {
+		w.Unlock(1)
+	}
+	assert.PanicsWithValue(t, "smutex: Unlock of unlocked mutex", func() { w.Unlock(1) })
+}
+
+func TestWeightedZero(t *testing.T) {
+	assert.PanicsWithValue(t, "smutex: NewWeighted with zero capacity", func() { NewWeighted(0) })
+}